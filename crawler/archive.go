@@ -0,0 +1,102 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+)
+
+// Maximum amount of bytes read from the end of an archive to list its files
+const ARCHIVE_MAX_DIRECTORY_SIZE = 16 * 1024 * 1024
+
+// Minimum amount of bytes requested at once while reading an archive directory
+const ARCHIVE_READ_SIZE = 64 * 1024
+
+/* An io.ReaderAt that only fetches the end of a file. Zip archives store
+ * their central directory right before the end record, so the buffer is
+ * extended towards the start of the file as needed.
+ */
+type archiveReaderAt struct {
+	read   RangeReader
+	size   int64
+	buf    []byte
+	offset int64
+}
+
+func (r *archiveReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 || off >= r.size {
+		return 0, io.EOF
+	}
+
+	if off < r.offset {
+		start := r.offset - ARCHIVE_READ_SIZE
+		if off < start {
+			start = off
+		}
+		if start < 0 {
+			start = 0
+		}
+
+		if r.size-start > ARCHIVE_MAX_DIRECTORY_SIZE {
+			return 0, fmt.Errorf("archive directory exceeds %d bytes", ARCHIVE_MAX_DIRECTORY_SIZE)
+		}
+
+		var data []byte
+		data, err = readRange(r.read, start, r.offset-start)
+		if err != nil {
+			return
+		}
+		if int64(len(data)) != r.offset-start {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		r.buf = append(data, r.buf...)
+		r.offset = start
+	}
+
+	n = copy(p, r.buf[off-r.offset:])
+	if n < len(p) {
+		err = io.EOF
+	}
+
+	return
+}
+
+// Whether the files within an archive can be listed
+func IsArchive(info FileInfo) bool {
+	return strings.EqualFold(path.Ext(info.URL.Path), ".zip") || info.SniffedMimeType == "application/zip"
+}
+
+/* List the files within a zip archive without downloading it. Only the central
+ * directory at the end of the archive is read. The files share the URL of the
+ * archive and are identified by their ArchivePath.
+ */
+func ListArchive(archive FileInfo, read RangeReader) (files []FileInfo, err error) {
+	reader, err := zip.NewReader(&archiveReaderAt{
+		read:   read,
+		size:   archive.Size,
+		offset: archive.Size,
+	}, archive.Size)
+	if err != nil {
+		return
+	}
+
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+
+		files = append(files, FileInfo{
+			URL:         archive.URL,
+			ArchivePath: strings.TrimPrefix(file.Name, "/"),
+			Size:        int64(file.UncompressedSize64),
+			MimeType:    mime.TypeByExtension(path.Ext(file.Name)),
+			ModTime:     file.Modified,
+		})
+	}
+
+	return
+}
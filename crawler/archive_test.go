@@ -0,0 +1,115 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListArchive(t *testing.T) {
+	modTime := time.Date(2018, 4, 1, 12, 30, 0, 0, time.UTC)
+
+	// Store a large file first, so the directory is far from the start
+	padding := make([]byte, 4*ARCHIVE_READ_SIZE)
+	rand.New(rand.NewSource(1)).Read(padding)
+
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for _, file := range []struct {
+		name    string
+		method  uint16
+		content []byte
+	}{
+		{"padding.bin", zip.Store, padding},
+		{"docs/", zip.Store, nil},
+		{"docs/readme.txt", zip.Deflate, []byte("hello world")},
+		{"/paper.pdf", zip.Deflate, []byte("%PDF-1.4")},
+	} {
+		w, err := writer.CreateHeader(&zip.FileHeader{
+			Name:     file.name,
+			Method:   file.method,
+			Modified: modTime,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(file.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	size := int64(len(data))
+
+	// Count the bytes that get requested from the start of the archive
+	var requested [][2]int64
+	read := func(offset int64, length int64) (io.ReadCloser, error) {
+		requested = append(requested, [2]int64{offset, length})
+		return ioutil.NopCloser(io.NewSectionReader(bytes.NewReader(data), offset, length)), nil
+	}
+
+	archiveUrl, _ := url.Parse("ftp://example.com/pub/docs.zip")
+	files, err := ListArchive(FileInfo{URL: archiveUrl, Size: size}, read)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []FileInfo{
+		{URL: archiveUrl, ArchivePath: "padding.bin", Size: int64(len(padding)), MimeType: mime.TypeByExtension(".bin"), ModTime: modTime},
+		{URL: archiveUrl, ArchivePath: "docs/readme.txt", Size: 11, MimeType: mime.TypeByExtension(".txt"), ModTime: modTime},
+		{URL: archiveUrl, ArchivePath: "paper.pdf", Size: 8, MimeType: mime.TypeByExtension(".pdf"), ModTime: modTime},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("got %d files, want %d", len(files), len(want))
+	}
+	for i := range want {
+		files[i].ModTime = files[i].ModTime.UTC()
+		if !reflect.DeepEqual(files[i], want[i]) {
+			t.Errorf("got %+v, want %+v", files[i], want[i])
+		}
+	}
+
+	// Only the tail containing the directory is fetched
+	if len(requested) == 0 {
+		t.Fatal("nothing was requested")
+	}
+
+	var total int64
+	for _, r := range requested {
+		if r[0] < size-ARCHIVE_READ_SIZE {
+			t.Errorf("requested %d bytes at %d, want only the last %d of %d bytes", r[1], r[0], ARCHIVE_READ_SIZE, size)
+		}
+		total += r[1]
+	}
+	if total > ARCHIVE_READ_SIZE {
+		t.Errorf("requested %d bytes, want at most %d", total, ARCHIVE_READ_SIZE)
+	}
+}
+
+func TestIsArchive(t *testing.T) {
+	for _, test := range []struct {
+		path     string
+		sniffed  string
+		expected bool
+	}{
+		{"/pub/docs.zip", "", true},
+		{"/pub/DOCS.ZIP", "", true},
+		{"/pub/docs", "application/zip", true},
+		{"/pub/docs.tar.gz", "application/gzip", false},
+	} {
+		fileUrl, _ := url.Parse("ftp://example.com" + test.path)
+		if IsArchive(FileInfo{URL: fileUrl, SniffedMimeType: test.sniffed}) != test.expected {
+			t.Errorf("%s (%q): want %v", test.path, test.sniffed, test.expected)
+		}
+	}
+}
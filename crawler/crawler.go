@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -22,23 +23,72 @@ type FileInfo struct {
 	Size     int64
 	MimeType string
 	ModTime  time.Time
+
+	// Fingerprint of the content, empty if unknown
+	ContentHash string
+
+	// Type detected by magic numbers, empty if unknown
+	SniffedMimeType string
+
+	// Path of a file within the archive at URL, empty for regular files
+	ArchivePath string
 }
 
 type WalkFunction func(path string, info FileInfo)
 
+// Crawlers that resume unfinished turns report when the last turn started
+type TurnStarter interface {
+	TurnStart() time.Time
+}
+
 type Crawler interface {
 	// Start walking recursively and call fn on every file
 	Walk(fn WalkFunction) error
 
+	// Get the URL all files found by Walk start with
+	EntryUrl() *url.URL
+
 	// Tear down all open connections
 	Close()
 }
 
+// Get a copy of a directory URL that ends with a slash
+func dirUrl(entry *url.URL) *url.URL {
+	dir := *entry
+	if !strings.HasSuffix(dir.Path, "/") {
+		dir.Path += "/"
+	}
+	return &dir
+}
+
+// Delays between reconnection attempts of crawlers
+const (
+	BACKOFF_MIN = 2 * time.Second
+	BACKOFF_MAX = 5 * time.Minute
+)
+
+// Get the delay before the next reconnection attempt, doubling every attempt
+func Backoff(attempt int) time.Duration {
+	if attempt > 16 {
+		return BACKOFF_MAX
+	}
+
+	delay := BACKOFF_MIN << uint(attempt)
+	if delay > BACKOFF_MAX {
+		delay = BACKOFF_MAX
+	}
+
+	return delay
+}
+
 // Data structures only used to control instances of protocol specific crawlers
 
 type CrawlerConfig struct {
 	Entry     string        `json:"entry"`
 	TurnDelay time.Duration `json:"turnDelay"`
+
+	// Seconds to keep files that disappeared from the server
+	StaleGracePeriod int64 `json:"staleGracePeriod"`
 }
 
 type CrawlersConfig struct {
@@ -57,18 +107,20 @@ type Crawlers struct {
 	Crawlers  []*CrawlerEntry
 	WaitGroup sync.WaitGroup
 	Model     *Model
+	Indexer   *Indexer
 }
 
-func CreateCrawlers(configPath string, model *Model) (crawlers *Crawlers, err error) {
+func CreateCrawlers(configPath string, model *Model, indexer *Indexer) (crawlers *Crawlers, err error) {
 	crawlers = &Crawlers{
-		Model: model,
+		Model:   model,
+		Indexer: indexer,
 	}
 
 	// Initially load config
 	crawlers.Load(configPath)
 
 	// Initialize config reloading using syscall
-	reloadChan := make(chan os.Signal)
+	reloadChan := make(chan os.Signal, 1)
 	signal.Notify(reloadChan, syscall.SIGUSR1)
 	go func() {
 		for {
@@ -157,8 +209,14 @@ OUTER:
 			switch entryUrl.Scheme {
 			case "http", "https":
 				crawler, gErr = CreateHttpCrawler(entry.RawConfig)
-			case "ftp":
+			case "ftp", "ftps":
 				crawler, gErr = CreateFtpCrawler(entry.RawConfig)
+			case "sftp":
+				crawler, gErr = CreateSftpCrawler(entry.RawConfig)
+			case "smb":
+				crawler, gErr = CreateSmbCrawler(entry.RawConfig)
+			case "webdav", "webdavs", "dav", "davs":
+				crawler, gErr = CreateWebdavCrawler(entry.RawConfig)
 			default:
 				gErr = fmt.Errorf("Unkonwn protocol: %s", entryUrl.Scheme)
 			}
@@ -176,7 +234,7 @@ OUTER:
 				case <-entry.Terminate:
 					return
 				default:
-					gErr = crawler.Walk(crawlers.WalkFn)
+					gErr = crawlers.Turn(entry, crawler)
 					if gErr != nil {
 						log.Println(gErr)
 						// Do not terminate as of Walk errors, just keep trying
@@ -192,28 +250,79 @@ OUTER:
 	return
 }
 
-func (crawlers *Crawlers) WalkFn(currentPath string, info FileInfo) {
-	// get url without path
-	urlCpy := *info.URL
-	infoPath := urlCpy.Path
+/* Walk a server once. After a successful turn, the entry is removed from all
+ * files below it that it did not list during the turn. Other entries on the
+ * same server are not affected.
+ */
+func (crawlers *Crawlers) Turn(entry *CrawlerEntry, crawler Crawler) (err error) {
+	turnStart := time.Now()
+
+	err = crawler.Walk(func(currentPath string, info FileInfo) {
+		crawlers.WalkFn(entry, currentPath, info)
+	})
+	if err != nil {
+		return
+	}
+
+	entryUrl := crawler.EntryUrl()
+
+	// Make sure all files of this turn got their LastSeen updated. Files that
+	// could not be indexed would be removed as stale otherwise
+	if crawlers.Indexer.Flush(entry.Config.Entry) {
+		err = fmt.Errorf("%s: files could not be indexed, not removing stale files", entryUrl.Redacted())
+		return
+	}
+
+	// The turn might have been resumed after a restart
+	if turnStarter, ok := crawler.(TurnStarter); ok {
+		turnStart = turnStarter.TurnStart()
+	}
+
+	// Also run if the turn found no files at all, so files that are gone get
+	// removed
+	serverUrl, pathPrefix := splitFileUrl(entryUrl)
+	before := turnStart.Add(-time.Duration(entry.Config.StaleGracePeriod) * time.Second)
+	return crawlers.Model.RemoveStaleEntry(serverUrl, pathPrefix, before)
+}
+
+// Split a file URL into the server URL and the path
+func splitFileUrl(fileUrl *url.URL) (serverUrl string, filePath string) {
+	urlCpy := *fileUrl
+	filePath = urlCpy.Path
 	urlCpy.Path = ""
-	infoUrl := urlCpy.String()
+	serverUrl = urlCpy.String()
+	return
+}
+
+func (crawlers *Crawlers) WalkFn(entry *CrawlerEntry, currentPath string, info FileInfo) {
+	// get url without path
+	infoUrl, infoPath := splitFileUrl(info.URL)
+
+	filename := path.Base(info.URL.Path)
+	if info.ArchivePath != "" {
+		filename = path.Base(info.ArchivePath)
+	}
 
 	file := ModelFileEntry{
-		Filename: path.Base(info.URL.Path),
+		Filename: filename,
 		Size:     info.Size,
 		MimeType: info.MimeType,
 		ModTime:  info.ModTime,
-		Servers: []ModelFileServerEntry{{
-			Url:  infoUrl,
-			Path: infoPath,
-		}},
-	}
+		LastSeen: time.Now(),
 
-	err := crawlers.Model.AddFileEntry(file)
-	if err != nil {
-		log.Println(err)
+		ContentHash:     info.ContentHash,
+		SniffedMimeType: info.SniffedMimeType,
+
+		Entry: entry.Config.Entry,
 	}
+	file.Servers = []ModelFileServerEntry{{
+		Url:         infoUrl,
+		Path:        infoPath,
+		ArchivePath: info.ArchivePath,
+		LastSeen:    file.LastSeen,
+	}}
+
+	crawlers.Indexer.Add(file)
 }
 
 func (crawlers *Crawlers) Run() {
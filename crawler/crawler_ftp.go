@@ -1,22 +1,48 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/jlaffaye/ftp"
 	"github.com/temoto/robotstxt"
+	"io"
 	"io/ioutil"
+	"log"
 	"mime"
+	"net/textproto"
 	"net/url"
 	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// How often listing a directory is retried after the connection broke
+const FTP_MAX_RETRIES = 3
+
 type FtpCrawlerConfig struct {
-	Entry         string        `json:"entry"`
-	RateLimit     time.Duration `json:"maxRequestPerSecond"`
-	RobotName     string        `json:"robotName"`
-	ObeyRobotsTxt bool          `json:"obeyRobotsTxt"`
+	Entry             string        `json:"entry"`
+	RateLimit         time.Duration `json:"maxRequestPerSecond"`
+	RobotName         string        `json:"robotName"`
+	ObeyRobotsTxt     bool          `json:"obeyRobotsTxt"`
+	ExplicitTLS       *bool         `json:"explicitTLS"`
+	VerifyCertificate bool          `json:"verifyCertificate"`
+	Mlsd              bool          `json:"mlsd"`
+	Timezone          string        `json:"timezone"`
+	Connections       int           `json:"connections"`
+	HashContent       bool          `json:"hashContent"`
+	HashChunkSize     int64         `json:"hashChunkSize"`
+	SniffMimeType     bool          `json:"sniffMimeType"`
+	ListArchives      bool          `json:"listArchives"`
+}
+
+// A control connection of the pool of a crawler
+type FtpConnection struct {
+	Conn *ftp.ServerConn
+	Mt   sync.Mutex
 }
 
 type FtpCrawler struct {
@@ -26,8 +52,11 @@ type FtpCrawler struct {
 	AuthUser string
 	Entry    *url.URL
 
-	Conn            *ftp.ServerConn
-	ConnMt          sync.Mutex
+	Conns           []*FtpConnection
+	LastTurnStart   time.Time
+	TLSConfig       *tls.Config
+	Location        *time.Location
+	ListFallback    atomic.Bool
 	RobotsTestAgent *robotstxt.Group
 	Terminate       chan bool
 	Ticker          <-chan time.Time
@@ -47,6 +76,10 @@ func CreateFtpCrawler(rawConfig *json.RawMessage) (crawler *FtpCrawler, err erro
 		RateLimit:     0,
 		RobotName:     DEFAULT_BOTNAME,
 		ObeyRobotsTxt: true,
+		Mlsd:          true,
+		Timezone:      "UTC",
+		Connections:   1,
+		HashChunkSize: DEFAULT_HASH_CHUNK_SIZE,
 	}
 	err = json.Unmarshal(*rawConfig, &config)
 	if err != nil {
@@ -55,6 +88,11 @@ func CreateFtpCrawler(rawConfig *json.RawMessage) (crawler *FtpCrawler, err erro
 
 	crawler.Config = config
 
+	if crawler.Config.Connections < 1 {
+		err = fmt.Errorf("connections has to be at least 1")
+		return
+	}
+
 	// Parse the entry URL
 	entry, err := url.Parse(crawler.Config.Entry)
 	if err != nil {
@@ -76,44 +114,38 @@ func CreateFtpCrawler(rawConfig *json.RawMessage) (crawler *FtpCrawler, err erro
 		}
 	}
 
-	// Determine port
-	port := "21"
-	if crawler.Entry.Port() != "" {
-		port = crawler.Entry.Port()
-	}
-
-	// Try to connect in a loop. High-Load FTPs likely need a few hundred tries
-	addr := crawler.Entry.Hostname() + ":" + port
-	for {
-		conn, err := ftp.Dial(addr)
-		if err == nil {
-			crawler.Conn = conn
-			break
-		}
+	crawler.TLSConfig = &tls.Config{
+		ServerName:         crawler.Entry.Hostname(),
+		InsecureSkipVerify: !crawler.Config.VerifyCertificate,
 
-		// TODO gradually slow down
-		time.Sleep(2 * time.Second)
+		// Some servers require data connections to resume the TLS session of
+		// the control connection
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
 	}
 
-	// Try to log-in in a loop. High-Load FTPs likely need a few hundred tries
-	for {
-		err := crawler.Conn.Login(crawler.AuthUser, crawler.AuthPass)
-		if err == nil {
-			break
-		}
-
-		// TODO gradually slow down
-		time.Sleep(2 * time.Second)
+	// Parse the time zone of LIST listings
+	crawler.Location, err = time.LoadLocation(crawler.Config.Timezone)
+	if err != nil {
+		return
 	}
 
-	// Give FTP some time to get ready, e.g. finish sending a motd. Otherwise it
-	// might happen that the FTP library interprets motd content as command
-	// response.
-	time.Sleep(5 * time.Second)
+	// Open all connections of the pool at once
+	var wg sync.WaitGroup
+	for i := 0; i < crawler.Config.Connections; i++ {
+		conn := &FtpConnection{}
+		crawler.Conns = append(crawler.Conns, conn)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			crawler.connect(conn)
+		}()
+	}
+	wg.Wait()
 
 	// Try to parse robots.txt
 	if crawler.Config.ObeyRobotsTxt {
-		robotsRes, robotsErr := crawler.Conn.Retr("/robots.txt")
+		robotsRes, robotsErr := crawler.Conns[0].Conn.Retr("/robots.txt")
 		if robotsErr == nil {
 			defer robotsRes.Close()
 
@@ -133,16 +165,21 @@ func CreateFtpCrawler(rawConfig *json.RawMessage) (crawler *FtpCrawler, err erro
 		}
 	}
 
-	// Repeatedly send NoOps to prevent the connection from closing
+	// Repeatedly send NoOps to prevent the connections from closing
 	go func() {
 		for {
 			select {
 			case <-crawler.Terminate:
 				return
 			default:
-				crawler.ConnMt.Lock()
-				crawler.Conn.NoOp()
-				crawler.ConnMt.Unlock()
+				// Busy connections do not need a NoOp. Also do not wait for
+				// connections that are reconnecting
+				for _, conn := range crawler.Conns {
+					if conn.Mt.TryLock() {
+						conn.Conn.NoOp()
+						conn.Mt.Unlock()
+					}
+				}
 				time.Sleep(15 * time.Second)
 			}
 		}
@@ -151,59 +188,339 @@ func CreateFtpCrawler(rawConfig *json.RawMessage) (crawler *FtpCrawler, err erro
 	return
 }
 
-func (crawler *FtpCrawler) walker(entry *url.URL, fn WalkFunction) (err error) {
+/* Connect and log in to the server. Blocks until it succeeded. Callers that
+ * might run concurrently to the walker have to hold the connection mutex.
+ */
+func (crawler *FtpCrawler) connect(conn *FtpConnection) {
+	if conn.Conn != nil {
+		conn.Conn.Quit()
+	}
+
+	// Determine port
+	port := "21"
+	if crawler.Entry.Scheme == "ftps" {
+		port = "990"
+	}
+	if crawler.Entry.Port() != "" {
+		port = crawler.Entry.Port()
+	}
+
+	// Use MLSD listings unless they are disabled or did not work before
+	options := []ftp.DialOption{
+		ftp.DialWithTimeout(30 * time.Second),
+		ftp.DialWithDisabledMLSD(!crawler.Config.Mlsd || crawler.ListFallback.Load()),
+		ftp.DialWithLocation(crawler.Location),
+	}
+
+	// Try to connect and log in in a loop. High-Load FTPs likely need a few
+	// hundred tries, so we gradually slow down
+	addr := crawler.Entry.Hostname() + ":" + port
+	for attempt := 0; ; attempt++ {
+		serverConn, err := crawler.dial(addr, options...)
+		if err == nil {
+			err = serverConn.Login(crawler.AuthUser, crawler.AuthPass)
+			if err == nil {
+				conn.Conn = serverConn
+				break
+			}
+
+			serverConn.Quit()
+		}
+
+		delay := Backoff(attempt)
+		log.Printf("%s: connecting failed, retrying in %s: %s\n", crawler.Entry.Host, delay, err)
+		time.Sleep(delay)
+	}
+
+	// Give FTP some time to get ready, e.g. finish sending a motd. Otherwise it
+	// might happen that the FTP library interprets motd content as command
+	// response.
+	time.Sleep(5 * time.Second)
+}
+
+/* Connect to the server using TLS where possible. ftps:// uses implicit TLS.
+ * ftp:// upgrades the connection using AUTH TLS before logging in unless
+ * explicitTLS is false. Plain FTP is only used if the server does not support
+ * AUTH TLS and explicitTLS is not true.
+ */
+func (crawler *FtpCrawler) dial(addr string, options ...ftp.DialOption) (conn *ftp.ServerConn, err error) {
+	if crawler.Entry.Scheme == "ftps" {
+		return ftp.Dial(addr, append(options, ftp.DialWithTLS(crawler.TLSConfig))...)
+	}
+
+	explicitTLS := crawler.Config.ExplicitTLS
+	if explicitTLS != nil && !*explicitTLS {
+		return ftp.Dial(addr, options...)
+	}
+
+	conn, err = ftp.Dial(addr, append(options, ftp.DialWithExplicitTLS(crawler.TLSConfig))...)
+
+	// AUTH TLS got rejected, so this server does not offer TLS at all
+	if tpErr, ok := err.(*textproto.Error); ok && tpErr.Code >= 500 && explicitTLS == nil {
+		return ftp.Dial(addr, options...)
+	}
+
+	return
+}
+
+// Check if an error means that the connection broke, not that a command got rejected
+func isFtpConnectionError(err error) bool {
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) {
+		return true
+	}
+
+	return tpErr.Code == 421 || tpErr.Code == 425 || tpErr.Code == 426
+}
+
+/* List a directory. MLSD is used if the server announces MLST within its
+ * FEAT response, as it provides precise modification times and does not
+ * depend on the format of human readable LIST output. If the server does not
+ * understand MLSD after all, we reconnect and use LIST from then on.
+ */
+func (crawler *FtpCrawler) list(conn *FtpConnection, dirPath string) (files []*ftp.Entry, err error) {
+	conn.Mt.Lock()
+	defer conn.Mt.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		files, err = conn.Conn.List(dirPath)
+		if err == nil {
+			break
+		}
+
+		var tpErr *textproto.Error
+		isTpErr := errors.As(err, &tpErr)
+
+		if isTpErr && tpErr.Code >= 500 && tpErr.Code <= 504 && conn.Conn.IsTimePreciseInList() {
+			log.Printf("%s: MLSD failed, falling back to LIST: %s\n", crawler.Entry.Host, err)
+
+			crawler.ListFallback.Store(true)
+			crawler.connect(conn)
+			continue
+		}
+
+		// Reconnect if the connection broke and try the same directory again,
+		// so the walk does not have to start over
+		if isFtpConnectionError(err) && attempt < FTP_MAX_RETRIES {
+			log.Printf("%s: connection lost, reconnecting: %s\n", crawler.Entry.Host, err)
+
+			crawler.connect(conn)
+			continue
+		}
+
+		return
+	}
+
+	// MLSD times are always UTC, but the FTP library parses them within the
+	// time zone meant for LIST
+	if conn.Conn.IsTimePreciseInList() {
+		for _, file := range files {
+			t := file.Time
+			file.Time = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+		}
+	}
+
+	return
+}
+
+/* Read parts of a file using REST and RETR. The transfers are aborted once
+ * enough data was read. The caller has to hold the connection mutex.
+ */
+func (crawler *FtpCrawler) rangeReader(conn *FtpConnection, filePath string) RangeReader {
+	return func(offset int64, length int64) (rc io.ReadCloser, err error) {
+		if crawler.Config.RateLimit > 0 {
+			<-crawler.Ticker
+		}
+
+		res, err := conn.Conn.RetrFrom(filePath, uint64(offset))
+		if err != nil {
+			return
+		}
+
+		return ftpPartialResponse{res}, nil
+	}
+}
+
+// Detect the type of a file, fingerprint it and list the files of archives, if enabled
+func (crawler *FtpCrawler) inspect(conn *FtpConnection, info *FileInfo) (files []FileInfo) {
+	conn.Mt.Lock()
+	defer conn.Mt.Unlock()
+
+	read := crawler.rangeReader(conn, info.URL.Path)
+
+	var err error
+	if crawler.Config.SniffMimeType && info.Size > 0 {
+		info.SniffedMimeType, err = SniffMimeType(info.Size, read)
+		if err != nil {
+			log.Printf("%s: sniffing %s failed: %s\n", crawler.Entry.Host, info.URL.Path, err)
+		}
+	}
+
+	if crawler.Config.HashContent && info.Size > 0 {
+		info.ContentHash, err = Fingerprint(info.Size, crawler.Config.HashChunkSize*1024, read)
+		if err != nil {
+			log.Printf("%s: fingerprinting %s failed: %s\n", crawler.Entry.Host, info.URL.Path, err)
+		}
+	}
+
+	if crawler.Config.ListArchives && info.Size > 0 && IsArchive(*info) {
+		files, err = ListArchive(*info, read)
+		if err != nil {
+			log.Printf("%s: listing archive %s failed: %s\n", crawler.Entry.Host, info.URL.Path, err)
+		}
+	}
+
+	return
+}
+
+// Aborting a transfer makes the server reply with an error we do not care about
+type ftpPartialResponse struct {
+	*ftp.Response
+}
+
+func (res ftpPartialResponse) Close() error {
+	res.Response.Close()
+	return nil
+}
+
+// List a single directory, call fn on its files and queue its directories
+func (crawler *FtpCrawler) walker(conn *FtpConnection, entry *url.URL, frontier *Frontier, fn WalkFunction) (err error) {
 	// Check if this file is allowed to be crawled by robots.txt rules
 	if crawler.RobotsTestAgent != nil && !crawler.RobotsTestAgent.Test(entry.String()) {
 		return
 	}
 
-	// Throttle requests as specified by the RateLimit if needed
+	// Throttle requests as specified by the RateLimit if needed. The ticker is
+	// shared by all connections
 	if crawler.Config.RateLimit > 0 {
 		<-crawler.Ticker
 	}
 
-	crawler.ConnMt.Lock()
-	files, err := crawler.Conn.List(entry.Path)
-	crawler.ConnMt.Unlock()
+	files, err := crawler.list(conn, entry.Path)
+
+	// Skip directories that we are not allowed to list or that vanished
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) && (tpErr.Code == 550 || tpErr.Code == 450) {
+		log.Printf("%s: skipping %s: %s\n", crawler.Entry.Host, entry.Path, err)
+		return nil
+	}
 	if err != nil {
 		return
 	}
 
 	for _, file := range files {
-		// only go deeper
-		if file.Name == "." || file.Name == ".." {
+		// only go deeper. The FTP library reports the cdir and pdir entries of
+		// MLSD listings as directories, they are named "." and ".." or by their
+		// full path
+		if file.Name == "." || file.Name == ".." || strings.Contains(file.Name, "/") {
 			continue
 		}
 
 		entryUrl := *entry
 		entryUrl.Path = path.Join(entry.Path, file.Name)
 
-		// We only continue walking on directories
-		if file.Type == ftp.EntryTypeFile {
-			// TODO find out the mime type using magic numbers
-			fn("", FileInfo{
+		// Index files and continue walking on directories. Links are skipped as
+		// they might loop, just like entries of unknown types
+		switch file.Type {
+		case ftp.EntryTypeFile:
+			info := FileInfo{
 				URL:      &entryUrl,
 				Size:     int64(file.Size),
 				MimeType: mime.TypeByExtension(path.Ext(entryUrl.Path)),
 				ModTime:  file.Time,
-			})
-			continue
-		}
+			}
+			files := crawler.inspect(conn, &info)
 
-		err = crawler.walker(&entryUrl, fn)
-		if err != nil {
-			return
+			fn("", info)
+			for _, file := range files {
+				fn("", file)
+			}
+		case ftp.EntryTypeFolder:
+			frontier.Push(&entryUrl)
 		}
 	}
 
 	return
 }
 
-func (crawler *FtpCrawler) Walk(fn WalkFunction) error {
-	return crawler.walker(crawler.Entry, fn)
+/* Walk the server using all connections of the pool. Every connection lists
+ * directories taken from a shared frontier. Failed directories are logged and
+ * retried by the next turn. If reconnecting fails, the walk is aborted and the
+ * next turn continues where it stopped. Unfinished turns are also resumed
+ * after a restart.
+ */
+func (crawler *FtpCrawler) Walk(fn WalkFunction) (err error) {
+	frontier, err := CreatePersistentFrontier(crawler.Config.Entry, crawler.Entry)
+	if err != nil {
+		return
+	}
+	crawler.LastTurnStart = frontier.TurnStart
+
+	var wg sync.WaitGroup
+	var errMt sync.Mutex
+
+	for _, conn := range crawler.Conns {
+		wg.Add(1)
+		go func(conn *FtpConnection) {
+			defer wg.Done()
+
+			for {
+				entry, ok := frontier.Pop()
+				if !ok {
+					return
+				}
+
+				wErr := crawler.walker(conn, entry, frontier, fn)
+				if wErr != nil {
+					frontier.Fail(entry)
+
+					// list already tried to reconnect, so the server is gone
+					if isFtpConnectionError(wErr) {
+						errMt.Lock()
+						if err == nil {
+							err = wErr
+						}
+						errMt.Unlock()
+
+						frontier.Stop()
+						continue
+					}
+
+					log.Printf("%s: %s: %s\n", crawler.Entry.Host, entry.Path, wErr)
+					continue
+				}
+
+				frontier.Done(entry)
+			}
+		}(conn)
+	}
+
+	wg.Wait()
+
+	if cErr := frontier.Close(); cErr != nil {
+		log.Println(cErr)
+	}
+
+	// Directories might also have failed before a restart
+	if err == nil && frontier.Failures > 0 {
+		err = fmt.Errorf("%s: %d directories failed during this turn", crawler.Entry.Host, frontier.Failures)
+	}
+
+	return
+}
+
+// The start of the last turn, which might have begun before a restart
+func (crawler *FtpCrawler) TurnStart() time.Time {
+	return crawler.LastTurnStart
+}
+
+func (crawler *FtpCrawler) EntryUrl() *url.URL {
+	return dirUrl(crawler.Entry)
 }
 
 func (crawler *FtpCrawler) Close() {
 	crawler.Terminate <- true
-	crawler.Conn.Quit()
+	for _, conn := range crawler.Conns {
+		conn.Conn.Quit()
+	}
 }
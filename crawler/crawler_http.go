@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
@@ -9,6 +10,7 @@ import (
 	"golang.org/x/net/html"
 	"io"
 	"io/ioutil"
+	"log"
 	"mime"
 	"net/http"
 	"net/url"
@@ -16,6 +18,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -38,12 +41,18 @@ type HttpCrawlerConfig struct {
 	RateLimit     time.Duration `json:"maxRequestPerSecond"`
 	RobotName     string        `json:"robotName"`
 	ObeyRobotsTxt bool          `json:"obeyRobotsTxt"`
+	Workers       int           `json:"workers"`
+	HashContent   bool          `json:"hashContent"`
+	HashChunkSize int64         `json:"hashChunkSize"`
+	SniffMimeType bool          `json:"sniffMimeType"`
+	ListArchives  bool          `json:"listArchives"`
 }
 
 type HttpCrawler struct {
 	Config HttpCrawlerConfig
 
-	Entry *url.URL
+	Entry         *url.URL
+	LastTurnStart time.Time
 
 	RobotsTestAgent *robotstxt.Group
 	Ticker          <-chan time.Time
@@ -71,6 +80,8 @@ func CreateHttpCrawler(rawConfig *json.RawMessage) (crawler *HttpCrawler, err er
 		RateLimit:     0,
 		RobotName:     DEFAULT_BOTNAME,
 		ObeyRobotsTxt: true,
+		Workers:       1,
+		HashChunkSize: DEFAULT_HASH_CHUNK_SIZE,
 	}
 	err = json.Unmarshal(*rawConfig, &config)
 	if err != nil {
@@ -79,6 +90,11 @@ func CreateHttpCrawler(rawConfig *json.RawMessage) (crawler *HttpCrawler, err er
 
 	crawler.Config = config
 
+	if crawler.Config.Workers < 1 {
+		err = fmt.Errorf("workers has to be at least 1")
+		return
+	}
+
 	// Parse the entry URL
 	entry, err := url.Parse(crawler.Config.Entry)
 	if err != nil {
@@ -118,7 +134,94 @@ func (crawler *HttpCrawler) httpGet(reqUrl string) (resp *http.Response, err err
 	return crawler.HttpClient.Get(reqUrl)
 }
 
-func (crawler *HttpCrawler) walker(entry *url.URL, fn WalkFunction) (err error) {
+/* Read parts of a file. The start of the file is read from the body of the
+ * response that is already open, if any. Other parts are requested using Range
+ * requests.
+ */
+func (crawler *HttpCrawler) rangeReader(entry *url.URL, body io.Reader) RangeReader {
+	return func(offset int64, length int64) (rc io.ReadCloser, err error) {
+		if offset == 0 && body != nil {
+			return ioutil.NopCloser(body), nil
+		}
+
+		if crawler.Config.RateLimit > 0 {
+			<-crawler.Ticker
+		}
+
+		req, err := http.NewRequest("GET", entry.String(), nil)
+		if err != nil {
+			return
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+		rangeResp, err := crawler.HttpClient.Do(req)
+		if err != nil {
+			return
+		}
+
+		// Servers without Range support send the whole file
+		if rangeResp.StatusCode != http.StatusPartialContent {
+			rangeResp.Body.Close()
+			err = fmt.Errorf("range request failed: %s", rangeResp.Status)
+			return
+		}
+
+		return rangeResp.Body, nil
+	}
+}
+
+/* Detect the type of a file, fingerprint it and list the files of archives,
+ * if enabled. The head of the body is buffered, so it can be read by both the
+ * sniffer and the fingerprint.
+ */
+func (crawler *HttpCrawler) inspect(resp *http.Response, info *FileInfo) (files []FileInfo) {
+	body := bufio.NewReaderSize(resp.Body, SNIFF_SIZE)
+
+	var err error
+	if crawler.Config.SniffMimeType {
+		// Files without a known size are sniffed as well, as Range requests are
+		// only needed for signatures beyond the head
+		size := info.Size
+		if size == 0 {
+			size = -1
+		}
+
+		info.SniffedMimeType, err = SniffMimeType(size, func(offset int64, length int64) (io.ReadCloser, error) {
+			if offset == 0 {
+				head, _ := body.Peek(int(length))
+				return ioutil.NopCloser(bytes.NewReader(head)), nil
+			}
+			return crawler.rangeReader(info.URL, body)(offset, length)
+		})
+		if err != nil {
+			log.Printf("%s: sniffing failed: %s\n", info.URL, err)
+		}
+	}
+
+	// Files without a known size can not be fingerprinted
+	if crawler.Config.HashContent && info.Size > 0 {
+		info.ContentHash, err = Fingerprint(info.Size, crawler.Config.HashChunkSize*1024, crawler.rangeReader(info.URL, body))
+		if err != nil {
+			log.Printf("%s: fingerprinting failed: %s\n", info.URL, err)
+		}
+	}
+
+	// Archives are listed using Range requests only, as their directory is
+	// located at the end
+	if crawler.Config.ListArchives && info.Size > 0 && IsArchive(*info) {
+		files, err = ListArchive(*info, crawler.rangeReader(info.URL, nil))
+		if err != nil {
+			log.Printf("%s: listing archive failed: %s\n", info.URL, err)
+		}
+	}
+
+	return
+}
+
+/* Visit a single URL. Files are passed to fn, links within HTML pages are
+ * queued within the frontier.
+ */
+func (crawler *HttpCrawler) walker(entry *url.URL, frontier *Frontier, fn WalkFunction) (err error) {
 	entryStr := entry.String()
 
 	// Check if this file is allowed to be crawled by robots.txt rules
@@ -126,7 +229,8 @@ func (crawler *HttpCrawler) walker(entry *url.URL, fn WalkFunction) (err error)
 		return
 	}
 
-	// Throttle requests as specified by the RateLimit if needed
+	// Throttle requests as specified by the RateLimit if needed. The ticker is
+	// shared by all workers
 	if crawler.Config.RateLimit > 0 {
 		<-crawler.Ticker
 	}
@@ -140,6 +244,18 @@ func (crawler *HttpCrawler) walker(entry *url.URL, fn WalkFunction) (err error)
 	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
+
+	// Only server errors fail the turn. Pages that are gone or forbidden will
+	// not show up by retrying, so they are only logged
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = fmt.Errorf("unexpected status: %s", resp.Status)
+		if resp.StatusCode < 500 {
+			log.Printf("%s: %s\n", entryStr, err)
+			err = nil
+		}
+		return
+	}
 
 	// Determine the content length in bytes
 	var contentLength int64
@@ -154,9 +270,10 @@ func (crawler *HttpCrawler) walker(entry *url.URL, fn WalkFunction) (err error)
 	// WalkFunction on all other files
 	mimeType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
 	if err != nil {
-		// sometimes there is no Content-Type returned
-		// TODO implement fallback mime sniffing (magic numbers parsing)
-		mimeType = mime.TypeByExtension(path.Ext(entryStr))
+		// sometimes there is no Content-Type returned. Files are also sniffed
+		// using magic numbers if sniffMimeType is enabled
+		mimeType = mime.TypeByExtension(path.Ext(entry.Path))
+		err = nil
 	}
 
 	if mimeType != "text/html" {
@@ -170,12 +287,19 @@ func (crawler *HttpCrawler) walker(entry *url.URL, fn WalkFunction) (err error)
 			}
 		}
 
-		fn(entryStr, FileInfo{
+		info := FileInfo{
 			URL:      entry,
 			Size:     contentLength,
 			MimeType: mimeType,
 			ModTime:  modTime,
-		})
+		}
+
+		files := crawler.inspect(resp, &info)
+
+		fn(entryStr, info)
+		for _, file := range files {
+			fn(entryStr, file)
+		}
 
 		return
 	}
@@ -186,8 +310,6 @@ func (crawler *HttpCrawler) walker(entry *url.URL, fn WalkFunction) (err error)
 		return
 	}
 
-	resp.Body.Close()
-
 	if int64(len(body)) < contentLength {
 		err = fmt.Errorf("BodySizeLimit exceeded")
 		return
@@ -211,10 +333,11 @@ func (crawler *HttpCrawler) walker(entry *url.URL, fn WalkFunction) (err error)
 			if strings.ToLower(token.Data) == "a" {
 				for _, a := range token.Attr {
 					if a.Key == "href" {
-						var u *url.URL
-						u, err = url.Parse(a.Val)
-						if err != nil {
-							return
+						// Skip broken links instead of the whole page
+						u, pErr := url.Parse(a.Val)
+						if pErr != nil {
+							log.Printf("%s: skipping link: %s\n", entryStr, pErr)
+							break
 						}
 
 						nextUrl := entry.ResolveReference(u)
@@ -234,10 +357,10 @@ func (crawler *HttpCrawler) walker(entry *url.URL, fn WalkFunction) (err error)
 							break
 						}
 
-						// Stop if we have reached the maximum path depth
+						// Skip links below the maximum path depth
 						if pathDepth(nextUrl.Path) > crawler.Config.MaxPathDepth {
-							err = fmt.Errorf("MaxPathDepth exceeded")
-							return
+							log.Printf("%s: skipping link %s: MaxPathDepth exceeded\n", entryStr, nextUrl)
+							break
 						}
 
 						// Ignore Apache dir list sort links
@@ -247,24 +370,80 @@ func (crawler *HttpCrawler) walker(entry *url.URL, fn WalkFunction) (err error)
 							break
 						}
 
-						// Errors are bubbled up
-						err = crawler.walker(nextUrl, fn)
-						if err != nil {
-							return
-						}
-
+						frontier.Push(nextUrl)
 						break
 					}
 				}
 			}
 		}
 	}
+}
+
+/* Walk the server using a pool of workers that take URLs from a shared
+ * frontier. Every URL is visited once per turn. Errors are logged and do not
+ * stop the walk, but the turn is reported as failed afterwards. Unfinished
+ * turns are resumed after a restart.
+ */
+func (crawler *HttpCrawler) Walk(fn WalkFunction) (err error) {
+	frontier, err := CreatePersistentFrontier(crawler.Config.Entry, crawler.Entry)
+	if err != nil {
+		return
+	}
+	crawler.LastTurnStart = frontier.TurnStart
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < crawler.Config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				entry, ok := frontier.Pop()
+				if !ok {
+					return
+				}
+
+				wErr := crawler.walker(entry, frontier, fn)
+				if wErr != nil {
+					log.Printf("%s: %s\n", entry, wErr)
+
+					frontier.Fail(entry)
+					continue
+				}
+
+				frontier.Done(entry)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if cErr := frontier.Close(); cErr != nil {
+		log.Println(cErr)
+	}
+
+	// Failures might also have happened before a restart
+	if frontier.Failures > 0 {
+		err = fmt.Errorf("%s: %d requests failed during this turn", crawler.Entry, frontier.Failures)
+	}
 
 	return
 }
 
-func (crawler *HttpCrawler) Walk(fn WalkFunction) error {
-	return crawler.walker(crawler.Entry, fn)
+// The start of the last turn, which might have begun before a restart
+func (crawler *HttpCrawler) TurnStart() time.Time {
+	return crawler.LastTurnStart
+}
+
+// Files are found below the directory of the entry page
+func (crawler *HttpCrawler) EntryUrl() *url.URL {
+	entry := *crawler.Entry
+	entry.Path = entry.Path[:strings.LastIndex(entry.Path, "/")+1]
+	entry.RawPath = ""
+	entry.RawQuery = ""
+	entry.Fragment = ""
+	return &entry
 }
 
 func (crawler *HttpCrawler) Close() {
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/sftp"
+	"github.com/temoto/robotstxt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+type SftpCrawlerConfig struct {
+	Entry                 string        `json:"entry"`
+	RateLimit             time.Duration `json:"maxRequestPerSecond"`
+	RobotName             string        `json:"robotName"`
+	ObeyRobotsTxt         bool          `json:"obeyRobotsTxt"`
+	PrivateKey            string        `json:"privateKey"`
+	PrivateKeyPassphrase  string        `json:"privateKeyPassphrase"`
+	KnownHosts            string        `json:"knownHosts"`
+	HostKey               string        `json:"hostKey"`
+	InsecureIgnoreHostKey bool          `json:"insecureIgnoreHostKey"`
+}
+
+type SftpCrawler struct {
+	Config SftpCrawlerConfig
+
+	Entry        *url.URL
+	ClientConfig *ssh.ClientConfig
+
+	SshClient       *ssh.Client
+	Client          *sftp.Client
+	LastTurnStart   time.Time
+	RobotsTestAgent *robotstxt.Group
+	Ticker          <-chan time.Time
+}
+
+func CreateSftpCrawler(rawConfig *json.RawMessage) (crawler *SftpCrawler, err error) {
+	// Create a new instance
+	crawler = &SftpCrawler{}
+
+	// Parse config while providing default values
+	config := SftpCrawlerConfig{
+		RateLimit:     0,
+		RobotName:     DEFAULT_BOTNAME,
+		ObeyRobotsTxt: true,
+		KnownHosts:    filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts"),
+	}
+	err = json.Unmarshal(*rawConfig, &config)
+	if err != nil {
+		return
+	}
+
+	crawler.Config = config
+
+	// Parse the entry URL
+	entry, err := url.Parse(crawler.Config.Entry)
+	if err != nil {
+		return
+	}
+	crawler.Entry = entry
+
+	// Initialize the RateLimit throttle ticker if needed
+	if crawler.Config.RateLimit > 0 {
+		crawler.Ticker = time.Tick(crawler.Config.RateLimit)
+	}
+
+	crawler.ClientConfig, err = crawler.clientConfig()
+	if err != nil {
+		return
+	}
+
+	err = crawler.connect()
+	if err != nil {
+		return
+	}
+
+	// Try to parse robots.txt
+	if crawler.Config.ObeyRobotsTxt {
+		robotsRes, robotsErr := crawler.Client.Open("/robots.txt")
+		if robotsErr == nil {
+			defer robotsRes.Close()
+
+			var robotsData []byte
+			robotsData, err = ioutil.ReadAll(robotsRes)
+			if err != nil {
+				return
+			}
+
+			var robots *robotstxt.RobotsData
+			robots, err = robotstxt.FromBytes(robotsData)
+			if err != nil {
+				return
+			}
+
+			crawler.RobotsTestAgent = robots.FindGroup(crawler.Config.RobotName)
+		}
+	}
+
+	return
+}
+
+/* Create the SSH client config from the entry URL and the crawler config.
+ * Authentication uses the password of the entry URL and/or a private key.
+ * Host keys are checked against a single configured host key or a
+ * known_hosts file, unless insecureIgnoreHostKey is set.
+ */
+func (crawler *SftpCrawler) clientConfig() (config *ssh.ClientConfig, err error) {
+	userInfo := crawler.Entry.User
+	if userInfo == nil || userInfo.Username() == "" {
+		err = fmt.Errorf("%s: sftp needs a username", crawler.Entry.Host)
+		return
+	}
+
+	config = &ssh.ClientConfig{
+		User:    userInfo.Username(),
+		Timeout: 30 * time.Second,
+	}
+
+	if password, ok := userInfo.Password(); ok {
+		config.Auth = append(config.Auth,
+			ssh.Password(password),
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) (answers []string, err error) {
+				answers = make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return
+			}),
+		)
+	}
+
+	if crawler.Config.PrivateKey != "" {
+		var keyData []byte
+		keyData, err = ioutil.ReadFile(crawler.Config.PrivateKey)
+		if err != nil {
+			return
+		}
+
+		var signer ssh.Signer
+		if crawler.Config.PrivateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(keyData, []byte(crawler.Config.PrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(keyData)
+		}
+		if err != nil {
+			return
+		}
+
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+
+	if len(config.Auth) == 0 {
+		err = fmt.Errorf("%s: sftp needs a password or a private key", crawler.Entry.Host)
+		return
+	}
+
+	switch {
+	case crawler.Config.InsecureIgnoreHostKey:
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	case crawler.Config.HostKey != "":
+		var hostKey ssh.PublicKey
+		hostKey, _, _, _, err = ssh.ParseAuthorizedKey([]byte(crawler.Config.HostKey))
+		if err != nil {
+			return
+		}
+		config.HostKeyCallback = ssh.FixedHostKey(hostKey)
+	default:
+		config.HostKeyCallback, err = knownhosts.New(crawler.Config.KnownHosts)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// (Re-)connect to the server
+func (crawler *SftpCrawler) connect() (err error) {
+	crawler.disconnect()
+
+	// Determine port
+	port := "22"
+	if crawler.Entry.Port() != "" {
+		port = crawler.Entry.Port()
+	}
+
+	sshClient, err := ssh.Dial("tcp", crawler.Entry.Hostname()+":"+port, crawler.ClientConfig)
+	if err != nil {
+		return
+	}
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return
+	}
+
+	crawler.SshClient = sshClient
+	crawler.Client = client
+
+	return
+}
+
+func (crawler *SftpCrawler) disconnect() {
+	if crawler.Client != nil {
+		crawler.Client.Close()
+		crawler.Client = nil
+	}
+	if crawler.SshClient != nil {
+		crawler.SshClient.Close()
+		crawler.SshClient = nil
+	}
+}
+
+// List a single directory, call fn on its files and queue its directories
+func (crawler *SftpCrawler) walker(entry *url.URL, frontier *Frontier, fn WalkFunction) (err error) {
+	// Check if this file is allowed to be crawled by robots.txt rules
+	if crawler.RobotsTestAgent != nil && !crawler.RobotsTestAgent.Test(entry.Path) {
+		return
+	}
+
+	// Throttle requests as specified by the RateLimit if needed
+	if crawler.Config.RateLimit > 0 {
+		<-crawler.Ticker
+	}
+
+	files, err := crawler.Client.ReadDir(entry.Path)
+
+	// Skip directories the server refuses to list, e.g. because of missing
+	// permissions. Only transport errors fail the walk.
+	if _, refused := err.(*sftp.StatusError); refused || os.IsNotExist(err) {
+		log.Printf("%s: skipping %s: %s\n", crawler.Entry.Host, entry.Path, err)
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		entryUrl := *entry
+		entryUrl.Path = path.Join(entry.Path, file.Name())
+
+		// Follow symlinks to files, but not to directories as they might loop
+		if file.Mode()&os.ModeSymlink != 0 {
+			file, err = crawler.Client.Stat(entryUrl.Path)
+			if err != nil || file.IsDir() {
+				err = nil
+				continue
+			}
+		}
+
+		// We only continue walking on directories
+		if !file.IsDir() {
+			fn("", FileInfo{
+				URL:      &entryUrl,
+				Size:     file.Size(),
+				MimeType: mime.TypeByExtension(path.Ext(entryUrl.Path)),
+				ModTime:  file.ModTime(),
+			})
+			continue
+		}
+
+		frontier.Push(&entryUrl)
+	}
+
+	return
+}
+
+/* Walk the server directory by directory using a persistent frontier. The
+ * first error aborts the walk, the next turn reconnects and continues where it
+ * stopped. Unfinished turns are also resumed after a restart.
+ */
+func (crawler *SftpCrawler) Walk(fn WalkFunction) (err error) {
+	// Reconnect if the previous turn failed
+	if crawler.Client == nil {
+		err = crawler.connect()
+		if err != nil {
+			return
+		}
+	}
+
+	frontier, err := CreatePersistentFrontier(crawler.Config.Entry, crawler.fileEntry())
+	if err != nil {
+		return
+	}
+	crawler.LastTurnStart = frontier.TurnStart
+
+	for {
+		dir, ok := frontier.Pop()
+		if !ok {
+			break
+		}
+
+		wErr := crawler.walker(dir, frontier, fn)
+		if wErr != nil {
+			err = wErr
+
+			frontier.Fail(dir)
+			frontier.Stop()
+			crawler.disconnect()
+			continue
+		}
+
+		frontier.Done(dir)
+	}
+
+	if cErr := frontier.Close(); cErr != nil {
+		log.Println(cErr)
+	}
+
+	// Directories might also have failed before a restart
+	if err == nil && frontier.Failures > 0 {
+		err = fmt.Errorf("%s: %d directories failed during this turn", crawler.Entry.Host, frontier.Failures)
+	}
+
+	return
+}
+
+// The start of the last turn, which might have begun before a restart
+func (crawler *SftpCrawler) TurnStart() time.Time {
+	return crawler.LastTurnStart
+}
+
+// The entry as used within file URLs. Do not publish the password
+func (crawler *SftpCrawler) fileEntry() *url.URL {
+	entry := *crawler.Entry
+	entry.User = url.User(crawler.Entry.User.Username())
+	return &entry
+}
+
+func (crawler *SftpCrawler) EntryUrl() *url.URL {
+	return dirUrl(crawler.fileEntry())
+}
+
+func (crawler *SftpCrawler) Close() {
+	crawler.disconnect()
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const sftpTestUser = "crawler"
+const sftpTestPassword = "secret"
+
+// An in-process SSH server that only offers the sftp subsystem
+type sftpTestServer struct {
+	Addr    string
+	HostKey ssh.Signer
+
+	listener net.Listener
+}
+
+func generateTestKey(t *testing.T) (key *ecdsa.PrivateKey, signer ssh.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err = ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+// Write a private key in PEM format as it would be configured as privateKey
+func writeTestKey(t *testing.T, dir string, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(dir, "id_ecdsa")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keyPath
+}
+
+func startSftpTestServer(t *testing.T, clientKey ssh.PublicKey) *sftpTestServer {
+	_, hostKey := generateTestKey(t)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == sftpTestUser && string(password) == sftpTestPassword {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", conn.User())
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == sftpTestUser && bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &sftpTestServer{
+		Addr:     listener.Addr().String(),
+		HostKey:  hostKey,
+		listener: listener,
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, config)
+		}
+	}()
+
+	return server
+}
+
+func (server *sftpTestServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range channelRequests {
+				// The payload is the length prefixed subsystem name
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+
+				sftpServer, err := sftp.NewServer(channel, sftp.ReadOnly())
+				if err != nil {
+					channel.Close()
+					return
+				}
+				go func() {
+					sftpServer.Serve()
+					channel.Close()
+				}()
+			}
+		}()
+	}
+}
+
+func createTestSftpCrawler(t *testing.T, config map[string]interface{}) (*SftpCrawler, error) {
+	config["obeyRobotsTxt"] = false
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawConfig := json.RawMessage(data)
+
+	crawler, err := CreateSftpCrawler(&rawConfig)
+	if err == nil {
+		t.Cleanup(crawler.Close)
+	}
+
+	return crawler, err
+}
+
+func TestSftpCrawlerAuth(t *testing.T) {
+	dir := t.TempDir()
+
+	clientKey, clientSigner := generateTestKey(t)
+	keyPath := writeTestKey(t, dir, clientKey)
+	server := startSftpTestServer(t, clientSigner.PublicKey())
+	hostKey := string(ssh.MarshalAuthorizedKey(server.HostKey.PublicKey()))
+
+	otherClientKey, _ := generateTestKey(t)
+	otherKeyPath := writeTestKey(t, t.TempDir(), otherClientKey)
+	_, otherSigner := generateTestKey(t)
+	otherHostKey := string(ssh.MarshalAuthorizedKey(otherSigner.PublicKey()))
+
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	err := ioutil.WriteFile(knownHostsPath, []byte(knownhosts.Line([]string{knownhosts.Normalize(server.Addr)}, server.HostKey.PublicKey())+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrongKnownHostsPath := filepath.Join(dir, "known_hosts_wrong")
+	err = ioutil.WriteFile(wrongKnownHostsPath, []byte(knownhosts.Line([]string{knownhosts.Normalize(server.Addr)}, otherSigner.PublicKey())+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "known_hosts_empty"), nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		ok     bool
+	}{
+		{"password", map[string]interface{}{
+			"entry":      "sftp://" + sftpTestUser + ":" + sftpTestPassword + "@" + server.Addr + "/",
+			"knownHosts": knownHostsPath,
+		}, true},
+		{"wrong password", map[string]interface{}{
+			"entry":      "sftp://" + sftpTestUser + ":wrong@" + server.Addr + "/",
+			"knownHosts": knownHostsPath,
+		}, false},
+		{"private key", map[string]interface{}{
+			"entry":      "sftp://" + sftpTestUser + "@" + server.Addr + "/",
+			"privateKey": keyPath,
+			"hostKey":    hostKey,
+		}, true},
+		{"unknown private key", map[string]interface{}{
+			"entry":      "sftp://" + sftpTestUser + "@" + server.Addr + "/",
+			"privateKey": otherKeyPath,
+			"hostKey":    hostKey,
+		}, false},
+		{"wrong host key", map[string]interface{}{
+			"entry":   "sftp://" + sftpTestUser + ":" + sftpTestPassword + "@" + server.Addr + "/",
+			"hostKey": otherHostKey,
+		}, false},
+		{"wrong known host", map[string]interface{}{
+			"entry":      "sftp://" + sftpTestUser + ":" + sftpTestPassword + "@" + server.Addr + "/",
+			"knownHosts": wrongKnownHostsPath,
+		}, false},
+		{"unknown host", map[string]interface{}{
+			"entry":      "sftp://" + sftpTestUser + ":" + sftpTestPassword + "@" + server.Addr + "/",
+			"knownHosts": filepath.Join(dir, "known_hosts_empty"),
+		}, false},
+		{"ignored host key", map[string]interface{}{
+			"entry":                 "sftp://" + sftpTestUser + ":" + sftpTestPassword + "@" + server.Addr + "/",
+			"hostKey":               otherHostKey,
+			"insecureIgnoreHostKey": true,
+		}, true},
+	}
+
+	for _, test := range tests {
+		_, err := createTestSftpCrawler(t, test.config)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: connected, want an error", test.name)
+		}
+	}
+}
+
+func TestSftpCrawlerWalk(t *testing.T) {
+	useStateDir(t)
+
+	_, clientSigner := generateTestKey(t)
+	server := startSftpTestServer(t, clientSigner.PublicKey())
+
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"readme.txt":             "hello",
+		"docs/paper.pdf":         "%PDF-1.4",
+		"docs/drafts/draft.html": "<p>draft</p>",
+	} {
+		filePath := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Symlinks to files are followed, symlinks to directories are not
+	if err := os.Symlink(filepath.Join(root, "readme.txt"), filepath.Join(root, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(root, filepath.Join(root, "docs", "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	crawler, err := createTestSftpCrawler(t, map[string]interface{}{
+		"entry":   "sftp://" + sftpTestUser + ":" + sftpTestPassword + "@" + server.Addr + filepath.ToSlash(root),
+		"hostKey": string(ssh.MarshalAuthorizedKey(server.HostKey.PublicKey())),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	sizes := map[string]int64{}
+	err = crawler.Walk(func(currentPath string, info FileInfo) {
+		if info.URL.User.String() != sftpTestUser {
+			t.Errorf("%s: got user info %q, want %q", info.URL, info.URL.User, sftpTestUser)
+		}
+
+		files = append(files, info.URL.Path)
+		sizes[info.URL.Path] = info.Size
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := filepath.ToSlash(root)
+	want := []string{
+		base + "/docs/drafts/draft.html",
+		base + "/docs/paper.pdf",
+		base + "/link.txt",
+		base + "/readme.txt",
+	}
+	sort.Strings(files)
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("got files %q, want %q", files, want)
+	}
+
+	if sizes[base+"/link.txt"] != 5 {
+		t.Errorf("got size %d for the symlink, want the size of its target", sizes[base+"/link.txt"])
+	}
+}
+
+func TestSftpCrawlerWalkSkipsUnreadableDirectories(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions do not apply to root")
+	}
+	useStateDir(t)
+
+	_, clientSigner := generateTestKey(t)
+	server := startSftpTestServer(t, clientSigner.PublicKey())
+
+	root := t.TempDir()
+	for _, name := range []string{"locked/secret.txt", "public/readme.txt"} {
+		filePath := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filePath, []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Chmod(filepath.Join(root, "locked"), 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chmod(filepath.Join(root, "locked"), 0755)
+	})
+
+	crawler, err := createTestSftpCrawler(t, map[string]interface{}{
+		"entry":   "sftp://" + sftpTestUser + ":" + sftpTestPassword + "@" + server.Addr + filepath.ToSlash(root),
+		"hostKey": string(ssh.MarshalAuthorizedKey(server.HostKey.PublicKey())),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	err = crawler.Walk(func(currentPath string, info FileInfo) {
+		files = append(files, info.URL.Path)
+	})
+	if err != nil {
+		t.Fatalf("an unreadable directory failed the turn: %s", err)
+	}
+
+	want := []string{filepath.ToSlash(root) + "/public/readme.txt"}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("got files %q, want %q", files, want)
+	}
+	if crawler.Client == nil {
+		t.Error("an unreadable directory dropped the connection")
+	}
+}
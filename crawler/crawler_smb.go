@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hirochachacha/go-smb2"
+	"github.com/temoto/robotstxt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+type SmbCrawlerConfig struct {
+	Entry         string        `json:"entry"`
+	RateLimit     time.Duration `json:"maxRequestPerSecond"`
+	RobotName     string        `json:"robotName"`
+	ObeyRobotsTxt bool          `json:"obeyRobotsTxt"`
+	Domain        string        `json:"domain"`
+}
+
+type SmbCrawler struct {
+	Config SmbCrawlerConfig
+
+	AuthPass string
+	AuthUser string
+	Entry    *url.URL
+
+	// Share and directory within the share to start at. An empty share means
+	// that all shares of the server are crawled
+	Share string
+	Dir   string
+
+	Conn          net.Conn
+	Session       *smb2.Session
+	Mounts        map[string]*SmbMount
+	LastTurnStart time.Time
+	Ticker        <-chan time.Time
+}
+
+// A mounted share and the rules of its robots.txt
+type SmbMount struct {
+	Share           *smb2.Share
+	RobotsTestAgent *robotstxt.Group
+}
+
+func CreateSmbCrawler(rawConfig *json.RawMessage) (crawler *SmbCrawler, err error) {
+	// Create a new instance
+	crawler = &SmbCrawler{
+		AuthUser: "guest",
+		Mounts:   map[string]*SmbMount{},
+	}
+
+	// Parse config while providing default values
+	config := SmbCrawlerConfig{
+		RateLimit:     0,
+		RobotName:     DEFAULT_BOTNAME,
+		ObeyRobotsTxt: true,
+	}
+	err = json.Unmarshal(*rawConfig, &config)
+	if err != nil {
+		return
+	}
+
+	crawler.Config = config
+
+	// Parse the entry URL
+	entry, err := url.Parse(crawler.Config.Entry)
+	if err != nil {
+		return
+	}
+	crawler.Entry = entry
+
+	// Initialize the RateLimit throttle ticker if needed
+	if crawler.Config.RateLimit > 0 {
+		crawler.Ticker = time.Tick(crawler.Config.RateLimit)
+	}
+
+	// Try to parse username and password from the URL
+	userInfo := crawler.Entry.User
+	if userInfo != nil {
+		crawler.AuthUser = userInfo.Username()
+		if _pass, ok := userInfo.Password(); ok {
+			crawler.AuthPass = _pass
+		}
+	}
+
+	crawler.Share, crawler.Dir = splitSmbPath(crawler.Entry.Path)
+
+	err = crawler.connect()
+	return
+}
+
+/* Split a path into the share and the directory within the share, e.g.
+ * /share/foo/bar. The share is empty for the root of the server.
+ */
+func splitSmbPath(smbPath string) (share string, dir string) {
+	parts := strings.SplitN(strings.Trim(path.Clean("/"+smbPath), "/"), "/", 2)
+	share = parts[0]
+	if len(parts) > 1 {
+		dir = parts[1]
+	}
+	return
+}
+
+// Filter hidden and administrative shares, e.g. IPC$ or C$
+func diskShares(names []string) (shares []string) {
+	for _, name := range names {
+		if name != "" && !strings.HasSuffix(name, "$") {
+			shares = append(shares, name)
+		}
+	}
+	return
+}
+
+// (Re-)connect to the server and log in
+func (crawler *SmbCrawler) connect() (err error) {
+	crawler.disconnect()
+
+	// Determine port
+	port := "445"
+	if crawler.Entry.Port() != "" {
+		port = crawler.Entry.Port()
+	}
+
+	conn, err := net.DialTimeout("tcp", crawler.Entry.Hostname()+":"+port, 30*time.Second)
+	if err != nil {
+		return
+	}
+
+	dialer := &smb2.Dialer{
+		Initiator: &smb2.NTLMInitiator{
+			User:     crawler.AuthUser,
+			Password: crawler.AuthPass,
+			Domain:   crawler.Config.Domain,
+		},
+	}
+
+	session, err := dialer.Dial(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	crawler.Conn = conn
+	crawler.Session = session
+
+	return
+}
+
+func (crawler *SmbCrawler) disconnect() {
+	crawler.umount()
+
+	if crawler.Session != nil {
+		crawler.Session.Logoff()
+		crawler.Session = nil
+	}
+	if crawler.Conn != nil {
+		crawler.Conn.Close()
+		crawler.Conn = nil
+	}
+}
+
+// Get the names of the disk shares of the server
+func (crawler *SmbCrawler) shares() (shares []string, err error) {
+	names, err := crawler.Session.ListSharenames()
+	if err != nil {
+		return
+	}
+
+	shares = diskShares(names)
+	return
+}
+
+/* Parse the robots.txt in the root of a share. Its rules apply to the paths
+ * within the share, e.g. /foo/bar for smb://host/share/foo/bar
+ */
+func (crawler *SmbCrawler) robots(share *smb2.Share) (robotsTestAgent *robotstxt.Group, err error) {
+	if !crawler.Config.ObeyRobotsTxt {
+		return
+	}
+
+	robotsRes, robotsErr := share.Open("robots.txt")
+	if robotsErr != nil {
+		return
+	}
+	defer robotsRes.Close()
+
+	robotsData, err := ioutil.ReadAll(robotsRes)
+	if err != nil {
+		return
+	}
+
+	robots, err := robotstxt.FromBytes(robotsData)
+	if err != nil {
+		return
+	}
+
+	robotsTestAgent = robots.FindGroup(crawler.Config.RobotName)
+	return
+}
+
+// Mount a share once per turn. Returns nil if the share is not accessible
+func (crawler *SmbCrawler) mount(shareName string) (mount *SmbMount) {
+	if mount, ok := crawler.Mounts[shareName]; ok {
+		return mount
+	}
+
+	share, err := crawler.Session.Mount(shareName)
+	if err != nil {
+		// Enumerated shares might not be accessible for us
+		log.Printf("%s: %s\n", crawler.Entry.Host, err)
+		crawler.Mounts[shareName] = nil
+		return
+	}
+
+	mount = &SmbMount{
+		Share: share,
+	}
+
+	mount.RobotsTestAgent, err = crawler.robots(share)
+	if err != nil {
+		log.Printf("%s: %s\n", crawler.Entry.Host, err)
+	}
+
+	crawler.Mounts[shareName] = mount
+	return
+}
+
+// Unmount all shares mounted during the turn
+func (crawler *SmbCrawler) umount() {
+	for _, mount := range crawler.Mounts {
+		if mount != nil {
+			mount.Share.Umount()
+		}
+	}
+	crawler.Mounts = map[string]*SmbMount{}
+}
+
+/* List a single directory, call fn on its files and queue its directories. The
+ * root of the server lists its shares.
+ */
+func (crawler *SmbCrawler) walker(entry *url.URL, frontier *Frontier, fn WalkFunction) (err error) {
+	shareName, dir := splitSmbPath(entry.Path)
+
+	if shareName == "" {
+		var shares []string
+		shares, err = crawler.shares()
+		if err != nil {
+			return
+		}
+
+		for _, shareName := range shares {
+			shareUrl := *entry
+			shareUrl.Path = "/" + shareName
+			frontier.Push(&shareUrl)
+		}
+		return
+	}
+
+	mount := crawler.mount(shareName)
+	if mount == nil {
+		return
+	}
+	robotsTestAgent := mount.RobotsTestAgent
+
+	// Check if this directory is allowed to be crawled by robots.txt rules
+	if robotsTestAgent != nil && !robotsTestAgent.Test("/"+dir) {
+		return
+	}
+
+	// Throttle requests as specified by the RateLimit if needed
+	if crawler.Config.RateLimit > 0 {
+		<-crawler.Ticker
+	}
+
+	files, err := mount.Share.ReadDir(dir)
+
+	// Skip directories we are not allowed to list or that vanished. Only
+	// transport errors fail the walk.
+	if os.IsPermission(err) || os.IsNotExist(err) {
+		log.Printf("%s: skipping %s: %s\n", crawler.Entry.Host, entry.Path, err)
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		filePath := path.Join(dir, file.Name())
+
+		entryUrl := *entry
+		entryUrl.Path = path.Join(entry.Path, file.Name())
+
+		// We only continue walking on directories. Directory symlinks and
+		// junctions are skipped as they might loop
+		if !file.IsDir() {
+			if robotsTestAgent != nil && !robotsTestAgent.Test("/"+filePath) {
+				continue
+			}
+
+			fn("", FileInfo{
+				URL:      &entryUrl,
+				Size:     file.Size(),
+				MimeType: mime.TypeByExtension(path.Ext(filePath)),
+				ModTime:  file.ModTime(),
+			})
+			continue
+		}
+
+		if file.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+
+		frontier.Push(&entryUrl)
+	}
+
+	return
+}
+
+/* Walk the shares directory by directory using a persistent frontier. The
+ * first error aborts the walk, the next turn reconnects and continues where it
+ * stopped. Unfinished turns are also resumed after a restart.
+ */
+func (crawler *SmbCrawler) Walk(fn WalkFunction) (err error) {
+	// Reconnect if the previous turn failed
+	if crawler.Session == nil {
+		err = crawler.connect()
+		if err != nil {
+			return
+		}
+	}
+
+	frontier, err := CreatePersistentFrontier(crawler.Config.Entry, crawler.fileEntry())
+	if err != nil {
+		return
+	}
+	crawler.LastTurnStart = frontier.TurnStart
+
+	crawler.umount()
+
+	for {
+		dir, ok := frontier.Pop()
+		if !ok {
+			break
+		}
+
+		wErr := crawler.walker(dir, frontier, fn)
+		if wErr != nil {
+			err = wErr
+
+			frontier.Fail(dir)
+			frontier.Stop()
+			crawler.disconnect()
+			continue
+		}
+
+		frontier.Done(dir)
+	}
+
+	crawler.umount()
+
+	if cErr := frontier.Close(); cErr != nil {
+		log.Println(cErr)
+	}
+
+	// Directories might also have failed before a restart
+	if err == nil && frontier.Failures > 0 {
+		err = fmt.Errorf("%s: %d directories failed during this turn", crawler.Entry.Host, frontier.Failures)
+	}
+
+	return
+}
+
+// The start of the last turn, which might have begun before a restart
+func (crawler *SmbCrawler) TurnStart() time.Time {
+	return crawler.LastTurnStart
+}
+
+// The entry as used within file URLs. Do not publish the password
+func (crawler *SmbCrawler) fileEntry() *url.URL {
+	entry := *crawler.Entry
+	if entry.User != nil {
+		entry.User = url.User(entry.User.Username())
+	}
+	entry.Path = path.Join("/", crawler.Share, crawler.Dir)
+	return &entry
+}
+
+func (crawler *SmbCrawler) EntryUrl() *url.URL {
+	return dirUrl(crawler.fileEntry())
+}
+
+func (crawler *SmbCrawler) Close() {
+	crawler.disconnect()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitSmbPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		share string
+		dir   string
+	}{
+		{"", "", ""},
+		{"/", "", ""},
+		{"/share", "share", ""},
+		{"/share/", "share", ""},
+		{"/share/foo/bar", "share", "foo/bar"},
+		{"/share/foo/bar/", "share", "foo/bar"},
+		{"//share//foo/./bar", "share", "foo/bar"},
+		{"/share/foo/../bar", "share", "bar"},
+		{"/share/../..", "", ""},
+		{"/My Files/foo", "My Files", "foo"},
+	}
+
+	for _, test := range tests {
+		share, dir := splitSmbPath(test.path)
+		if share != test.share || dir != test.dir {
+			t.Errorf("%q: got share %q and dir %q, want %q and %q", test.path, share, dir, test.share, test.dir)
+		}
+	}
+}
+
+func TestDiskShares(t *testing.T) {
+	names := []string{"IPC$", "public", "C$", "ADMIN$", "media", "print$", "", "dollar$sign"}
+	want := []string{"public", "media", "dollar$sign"}
+
+	if shares := diskShares(names); !reflect.DeepEqual(shares, want) {
+		t.Errorf("got %q, want %q", shares, want)
+	}
+}
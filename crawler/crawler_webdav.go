@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/temoto/robotstxt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The properties requested by every PROPFIND
+const webdavPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:">
+	<prop>
+		<resourcetype/>
+		<getcontentlength/>
+		<getcontenttype/>
+		<getlastmodified/>
+	</prop>
+</propfind>`
+
+// XML data structures of a PROPFIND multistatus response
+type WebdavProp struct {
+	Collection    *struct{} `xml:"resourcetype>collection"`
+	ContentLength string    `xml:"getcontentlength"`
+	ContentType   string    `xml:"getcontenttype"`
+	LastModified  string    `xml:"getlastmodified"`
+}
+
+type WebdavPropstat struct {
+	Prop   WebdavProp `xml:"prop"`
+	Status string     `xml:"status"`
+}
+
+type WebdavResponse struct {
+	Href      string           `xml:"href"`
+	Propstats []WebdavPropstat `xml:"propstat"`
+}
+
+type WebdavMultistatus struct {
+	Responses []WebdavResponse `xml:"DAV: response"`
+}
+
+// Get the properties of a response that were found by the server
+func (res WebdavResponse) Prop() (prop WebdavProp, ok bool) {
+	for _, propstat := range res.Propstats {
+		fields := strings.Fields(propstat.Status)
+		if len(fields) > 1 && fields[1] == "200" {
+			return propstat.Prop, true
+		}
+	}
+	return
+}
+
+type WebdavCrawlerConfig struct {
+	Entry         string        `json:"entry"`
+	MaxPathDepth  int           `json:"maxPathDepth"`
+	RateLimit     time.Duration `json:"maxRequestPerSecond"`
+	RobotName     string        `json:"robotName"`
+	ObeyRobotsTxt bool          `json:"obeyRobotsTxt"`
+}
+
+type WebdavCrawler struct {
+	Config WebdavCrawlerConfig
+
+	// The entry as http(s) URL without username and password
+	Entry    *url.URL
+	AuthUser string
+	AuthPass string
+
+	LastTurnStart   time.Time
+	RobotsTestAgent *robotstxt.Group
+	Ticker          <-chan time.Time
+	HttpClient      *http.Client
+}
+
+func CreateWebdavCrawler(rawConfig *json.RawMessage) (crawler *WebdavCrawler, err error) {
+	// Create a new instance
+	crawler = &WebdavCrawler{
+		// Share an http.Client so we can keep alive connections
+		HttpClient: &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost: 1024,
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+			},
+		},
+	}
+
+	// Parse config while providing default values
+	config := WebdavCrawlerConfig{
+		MaxPathDepth:  20,
+		RateLimit:     0,
+		RobotName:     DEFAULT_BOTNAME,
+		ObeyRobotsTxt: true,
+	}
+	err = json.Unmarshal(*rawConfig, &config)
+	if err != nil {
+		return
+	}
+
+	crawler.Config = config
+
+	// Parse the entry URL and turn it into the underlying http(s) URL
+	entry, err := url.Parse(crawler.Config.Entry)
+	if err != nil {
+		return
+	}
+
+	switch entry.Scheme {
+	case "webdav", "dav":
+		entry.Scheme = "http"
+	case "webdavs", "davs":
+		entry.Scheme = "https"
+	default:
+		err = fmt.Errorf("Unkonwn WebDAV protocol: %s", entry.Scheme)
+		return
+	}
+
+	// Try to parse username and password from the URL. They are sent using
+	// basic auth so they do not show up within the file URLs
+	if entry.User != nil {
+		crawler.AuthUser = entry.User.Username()
+		crawler.AuthPass, _ = entry.User.Password()
+		entry.User = nil
+	}
+
+	// Collections are always requested with a trailing slash
+	if !strings.HasSuffix(entry.Path, "/") {
+		entry.Path += "/"
+	}
+
+	crawler.Entry = entry
+
+	// Initialize the RateLimit throttle ticker if needed
+	if crawler.Config.RateLimit > 0 {
+		crawler.Ticker = time.Tick(crawler.Config.RateLimit)
+	}
+
+	// Try to parse /robots.txt
+	if crawler.Config.ObeyRobotsTxt {
+		robotsURL := *entry
+		robotsURL.Path = "/robots.txt"
+
+		robotsRes, robotsErr := crawler.request("GET", &robotsURL, nil)
+		if robotsErr == nil {
+			defer robotsRes.Body.Close()
+
+			var robots *robotstxt.RobotsData
+			robots, err = robotstxt.FromResponse(robotsRes)
+			if err != nil {
+				return
+			}
+
+			crawler.RobotsTestAgent = robots.FindGroup(crawler.Config.RobotName)
+		}
+	}
+
+	return
+}
+
+func (crawler *WebdavCrawler) request(method string, reqUrl *url.URL, body io.Reader) (resp *http.Response, err error) {
+	req, err := http.NewRequest(method, reqUrl.String(), body)
+	if err != nil {
+		return
+	}
+
+	if crawler.AuthUser != "" {
+		req.SetBasicAuth(crawler.AuthUser, crawler.AuthPass)
+	}
+
+	if method == "PROPFIND" {
+		req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+		req.Header.Set("Depth", "1")
+	}
+
+	return crawler.HttpClient.Do(req)
+}
+
+// List the members of a collection using PROPFIND
+func (crawler *WebdavCrawler) propfind(entry *url.URL) (multistatus WebdavMultistatus, err error) {
+	resp, err := crawler.request("PROPFIND", entry, strings.NewReader(webdavPropfindBody))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	// Only server errors fail the turn. Collections that are gone or forbidden
+	// will not show up by retrying, so they are only logged
+	if resp.StatusCode != http.StatusMultiStatus {
+		err = fmt.Errorf("PROPFIND failed: %s", resp.Status)
+		if resp.StatusCode < 500 {
+			log.Printf("%s: %s\n", entry, err)
+			err = nil
+		}
+		return
+	}
+
+	// Multistatus responses are not limited in size as they do not contain any
+	// file contents
+	var body bytes.Buffer
+	_, err = body.ReadFrom(resp.Body)
+	if err != nil {
+		return
+	}
+
+	err = xml.Unmarshal(body.Bytes(), &multistatus)
+	return
+}
+
+// List a single collection, call fn on its files and queue its collections
+func (crawler *WebdavCrawler) walker(entry *url.URL, frontier *Frontier, fn WalkFunction) (err error) {
+	// Check if this collection is allowed to be crawled by robots.txt rules
+	if crawler.RobotsTestAgent != nil && !crawler.RobotsTestAgent.Test(entry.Path) {
+		return
+	}
+
+	// Skip collections below the maximum path depth
+	if pathDepth(entry.Path) > crawler.Config.MaxPathDepth {
+		log.Printf("%s: MaxPathDepth exceeded\n", entry)
+		return
+	}
+
+	// Throttle requests as specified by the RateLimit if needed
+	if crawler.Config.RateLimit > 0 {
+		<-crawler.Ticker
+	}
+
+	multistatus, err := crawler.propfind(entry)
+	if err != nil {
+		return
+	}
+
+	for _, res := range multistatus.Responses {
+		href, hErr := url.Parse(res.Href)
+		if hErr != nil {
+			log.Printf("%s: skipping member: %s\n", entry, hErr)
+			continue
+		}
+
+		nextUrl := entry.ResolveReference(href)
+		nextUrl.User = nil
+
+		// Only walk into members of the current collection, this also skips
+		// the collection itself
+		if nextUrl.Host != entry.Host ||
+			!strings.HasPrefix(nextUrl.Path, entry.Path) ||
+			pathDepth(nextUrl.Path) != pathDepth(entry.Path)+1 {
+			continue
+		}
+
+		prop, ok := res.Prop()
+		if !ok {
+			continue
+		}
+
+		if prop.Collection != nil {
+			if !strings.HasSuffix(nextUrl.Path, "/") {
+				nextUrl.Path += "/"
+			}
+
+			frontier.Push(nextUrl)
+			continue
+		}
+
+		if crawler.RobotsTestAgent != nil && !crawler.RobotsTestAgent.Test(nextUrl.Path) {
+			continue
+		}
+
+		info := FileInfo{
+			URL: nextUrl,
+		}
+
+		info.Size, _ = strconv.ParseInt(prop.ContentLength, 10, 64)
+		info.ModTime, _ = http.ParseTime(prop.LastModified)
+
+		info.MimeType, _, err = mime.ParseMediaType(prop.ContentType)
+		if err != nil {
+			err = nil
+			info.MimeType = mime.TypeByExtension(path.Ext(nextUrl.Path))
+		}
+
+		fn(nextUrl.String(), info)
+	}
+
+	return
+}
+
+/* Walk the server collection by collection using a persistent frontier.
+ * Errors are logged and do not stop the walk, but the turn is reported as
+ * failed afterwards. Unfinished turns are resumed after a restart.
+ */
+func (crawler *WebdavCrawler) Walk(fn WalkFunction) (err error) {
+	frontier, err := CreatePersistentFrontier(crawler.Config.Entry, crawler.Entry)
+	if err != nil {
+		return
+	}
+	crawler.LastTurnStart = frontier.TurnStart
+
+	for {
+		entry, ok := frontier.Pop()
+		if !ok {
+			break
+		}
+
+		wErr := crawler.walker(entry, frontier, fn)
+		if wErr != nil {
+			log.Printf("%s: %s\n", entry, wErr)
+
+			frontier.Fail(entry)
+			continue
+		}
+
+		frontier.Done(entry)
+	}
+
+	if cErr := frontier.Close(); cErr != nil {
+		log.Println(cErr)
+	}
+
+	// Failures might also have happened before a restart
+	if frontier.Failures > 0 {
+		err = fmt.Errorf("%s: %d requests failed during this turn", crawler.Entry, frontier.Failures)
+	}
+
+	return
+}
+
+// The start of the last turn, which might have begun before a restart
+func (crawler *WebdavCrawler) TurnStart() time.Time {
+	return crawler.LastTurnStart
+}
+
+func (crawler *WebdavCrawler) EntryUrl() *url.URL {
+	return dirUrl(crawler.Entry)
+}
+
+func (crawler *WebdavCrawler) Close() {
+
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+/* Start a WebDAV server serving files from memory. PROPFIND requests for the
+ * collections within status are answered with that status instead.
+ */
+func startWebdavTestServer(t *testing.T, files map[string]string, status map[string]int) *httptest.Server {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+
+	for name, content := range files {
+		dir := "/"
+		for _, part := range strings.Split(path.Dir(name), "/")[1:] {
+			if part == "" {
+				continue
+			}
+
+			dir = path.Join(dir, part)
+			if err := fs.Mkdir(ctx, dir, 0755); err != nil && !os.IsExist(err) {
+				t.Fatal(err)
+			}
+		}
+
+		file, err := fs.OpenFile(ctx, name, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+
+	handler := &webdav.Handler{
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code, ok := status[r.URL.Path]; ok && r.Method == "PROPFIND" {
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// Walk the server and return the paths of all found files
+func walkWebdavTestServer(t *testing.T, server *httptest.Server) (files []string, err error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"entry":         strings.Replace(server.URL, "http://", "webdav://", 1) + "/",
+		"maxPathDepth":  2,
+		"obeyRobotsTxt": false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawConfig := json.RawMessage(data)
+
+	crawler, err := CreateWebdavCrawler(&rawConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = crawler.Walk(func(currentPath string, info FileInfo) {
+		files = append(files, info.URL.Path)
+	})
+
+	sort.Strings(files)
+	return
+}
+
+func TestWebdavCrawlerWalk(t *testing.T) {
+	useStateDir(t)
+
+	server := startWebdavTestServer(t, map[string]string{
+		"/readme.txt":          "hello",
+		"/docs/paper.pdf":      "%PDF-1.4",
+		"/docs/old/draft.txt":  "draft",
+		"/docs/old/a/deep.txt": "too deep",
+		"/private/secret.txt":  "secret",
+	}, map[string]int{
+		"/private/": http.StatusForbidden,
+	})
+
+	// Forbidden collections and collections below the maximum path depth are
+	// skipped without failing the turn
+	files, err := walkWebdavTestServer(t, server)
+	if err != nil {
+		t.Fatalf("skipped collections failed the turn: %s", err)
+	}
+
+	want := []string{"/docs/old/draft.txt", "/docs/paper.pdf", "/readme.txt"}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("got files %q, want %q", files, want)
+	}
+}
+
+func TestWebdavCrawlerWalkServerError(t *testing.T) {
+	useStateDir(t)
+
+	server := startWebdavTestServer(t, map[string]string{
+		"/readme.txt":      "hello",
+		"/broken/file.txt": "broken",
+		"/docs/paper.pdf":  "%PDF-1.4",
+	}, map[string]int{
+		"/broken/": http.StatusInternalServerError,
+	})
+
+	// A server error fails the turn, but does not stop the walk
+	files, err := walkWebdavTestServer(t, server)
+	if err == nil {
+		t.Error("a server error did not fail the turn")
+	}
+
+	want := []string{"/docs/paper.pdf", "/readme.txt"}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("got files %q, want %q", files, want)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+)
+
+// Default amount of KiB hashed at the start and at the end of a file
+const DEFAULT_HASH_CHUNK_SIZE = 64
+
+// Open a file at offset. Only length bytes are read before it gets closed
+type RangeReader func(offset int64, length int64) (io.ReadCloser, error)
+
+/* Get a fingerprint of a file by hashing its first and last chunkSize bytes,
+ * so files can be recognized under other names without downloading them
+ * completely. Files up to twice the chunk size are hashed completely. The
+ * chunk size is part of the fingerprint as fingerprints of different chunk
+ * sizes can not be compared.
+ */
+func Fingerprint(size int64, chunkSize int64, read RangeReader) (fingerprint string, err error) {
+	ranges := [][2]int64{{0, size}}
+	if size > 2*chunkSize {
+		ranges = [][2]int64{{0, chunkSize}, {size - chunkSize, chunkSize}}
+	}
+
+	hash := sha1.New()
+	for _, r := range ranges {
+		var rc io.ReadCloser
+		rc, err = read(r[0], r[1])
+		if err != nil {
+			return
+		}
+
+		_, err = io.CopyN(hash, rc, r[1])
+		rc.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	fingerprint = fmt.Sprintf("sha1-%dk:%x", chunkSize/1024, hash.Sum(nil))
+	return
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How often the state of a persistent frontier is written to disk
+const FRONTIER_SAVE_INTERVAL = 30 * time.Second
+
+// How often a failed URL is retried before the next turn starts from the entry
+const FRONTIER_MAX_RETRIES = 1
+
+/* The state of an unfinished turn as stored within the state directory.
+ * URLs are stored as references relative to the entry, so no credentials end
+ * up in the file.
+ */
+type FrontierState struct {
+	Entry     string    `json:"entry"`
+	TurnStart time.Time `json:"turnStart"`
+	Queue     []string  `json:"queue"`
+	Completed []string  `json:"completed"`
+	Failures  int       `json:"failures"`
+
+	// How often the queued URLs failed before
+	Retries map[string]int `json:"retries,omitempty"`
+}
+
+/* A Frontier is the work queue of a walk that is shared by multiple workers.
+ * Workers Pop an URL, process it, Push the URLs they discover and then mark
+ * the popped URL as Done. Once every pushed URL is done, the walk is complete
+ * and Pop stops blocking. Every URL is only queued once per turn.
+ */
+type Frontier struct {
+	Entry     *url.URL
+	TurnStart time.Time
+	Failures  int
+
+	mt       sync.Mutex
+	cond     *sync.Cond
+	queue    []*url.URL
+	inflight map[*url.URL]bool
+	failed   []*url.URL
+	retries  map[string]int
+	known    map[string]bool
+	pending  int
+	stopped  bool
+
+	// Persistence, only used by persistent frontiers
+	statePath string
+	terminate chan bool
+}
+
+func CreateFrontier(entry *url.URL) (frontier *Frontier) {
+	frontier = &Frontier{
+		Entry:     entry,
+		TurnStart: time.Now(),
+		inflight:  map[*url.URL]bool{},
+		retries:   map[string]int{},
+		known:     map[string]bool{},
+	}
+	frontier.cond = sync.NewCond(&frontier.mt)
+
+	frontier.Push(entry)
+
+	return
+}
+
+/* Create a frontier that survives restarts of the crawler. If the state
+ * directory contains an unfinished turn of the same entry, the turn is
+ * resumed. Otherwise a new turn is started. The state is saved regularly
+ * until Close is called.
+ */
+func CreatePersistentFrontier(key string, entry *url.URL) (frontier *Frontier, err error) {
+	frontier = CreateFrontier(entry)
+
+	if *stateDir == "" {
+		return
+	}
+
+	sum := sha1.Sum([]byte(key))
+	frontier.statePath = filepath.Join(*stateDir, hex.EncodeToString(sum[:])+".json")
+	frontier.terminate = make(chan bool)
+
+	data, err := ioutil.ReadFile(frontier.statePath)
+	switch {
+	case os.IsNotExist(err):
+		err = nil
+	case err != nil:
+		return
+	default:
+		state := FrontierState{}
+		err = json.Unmarshal(data, &state)
+		if err != nil {
+			return
+		}
+
+		err = frontier.restore(state)
+		if err != nil {
+			return
+		}
+
+		log.Printf("%s: resuming turn started at %s, %d URLs left\n", entry.Redacted(), state.TurnStart, len(state.Queue))
+	}
+
+	err = os.MkdirAll(*stateDir, 0755)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		for {
+			select {
+			case <-frontier.terminate:
+				return
+			case <-time.After(FRONTIER_SAVE_INTERVAL):
+				if sErr := frontier.save(); sErr != nil {
+					log.Println(sErr)
+				}
+			}
+		}
+	}()
+
+	return
+}
+
+// Get the reference of an URL that is stored within the state
+func (frontier *Frontier) ref(entry *url.URL) string {
+	return entry.RequestURI()
+}
+
+// Replace the queue with the one of a saved state
+func (frontier *Frontier) restore(state FrontierState) (err error) {
+	frontier.mt.Lock()
+	defer frontier.mt.Unlock()
+
+	frontier.TurnStart = state.TurnStart
+	frontier.Failures = state.Failures
+	frontier.queue = nil
+	frontier.pending = 0
+	frontier.known = map[string]bool{}
+	frontier.retries = map[string]int{}
+
+	for ref, retries := range state.Retries {
+		frontier.retries[ref] = retries
+	}
+
+	for _, ref := range state.Completed {
+		frontier.known[ref] = true
+	}
+
+	for _, ref := range state.Queue {
+		var refUrl *url.URL
+		refUrl, err = url.Parse(ref)
+		if err != nil {
+			return
+		}
+
+		frontier.known[ref] = true
+		frontier.queue = append(frontier.queue, frontier.Entry.ResolveReference(refUrl))
+		frontier.pending++
+	}
+
+	return
+}
+
+/* Get the current state. URLs that are being processed count as queued.
+ * Failed URLs count as queued until they were retried FRONTIER_MAX_RETRIES
+ * times, their failures only count once they are not retried anymore.
+ */
+func (frontier *Frontier) State() (state FrontierState) {
+	frontier.mt.Lock()
+	defer frontier.mt.Unlock()
+
+	state = FrontierState{
+		Entry:     frontier.Entry.Redacted(),
+		TurnStart: frontier.TurnStart,
+		Queue:     []string{},
+		Completed: []string{},
+		Failures:  frontier.Failures,
+		Retries:   map[string]int{},
+	}
+
+	queued := map[string]bool{}
+	for _, entry := range frontier.queue {
+		queued[frontier.ref(entry)] = true
+	}
+	for entry := range frontier.inflight {
+		queued[frontier.ref(entry)] = true
+	}
+	for ref := range queued {
+		if frontier.retries[ref] > 0 {
+			state.Retries[ref] = frontier.retries[ref]
+		}
+	}
+	for _, entry := range frontier.failed {
+		ref := frontier.ref(entry)
+		if frontier.retries[ref] < FRONTIER_MAX_RETRIES {
+			queued[ref] = true
+			state.Retries[ref] = frontier.retries[ref] + 1
+			state.Failures--
+		}
+	}
+
+	for ref := range frontier.known {
+		if queued[ref] {
+			state.Queue = append(state.Queue, ref)
+		} else {
+			state.Completed = append(state.Completed, ref)
+		}
+	}
+
+	return
+}
+
+// Write the state to the state directory
+func (frontier *Frontier) save() (err error) {
+	data, err := json.Marshal(frontier.State())
+	if err != nil {
+		return
+	}
+
+	// Replace the file atomically so a crash does not leave a broken state
+	tmpPath := frontier.statePath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmpPath, frontier.statePath)
+}
+
+// Add an URL to the queue unless it was already queued during this turn
+func (frontier *Frontier) Push(entry *url.URL) {
+	frontier.mt.Lock()
+	defer frontier.mt.Unlock()
+
+	ref := frontier.ref(entry)
+	if frontier.stopped || frontier.known[ref] {
+		return
+	}
+	frontier.known[ref] = true
+
+	frontier.queue = append(frontier.queue, entry)
+	frontier.pending++
+	frontier.cond.Signal()
+}
+
+/* Take the next URL from the queue. Blocks while the queue is empty but other
+ * workers might still push URLs. ok is false once the walk is complete or
+ * got stopped.
+ */
+func (frontier *Frontier) Pop() (entry *url.URL, ok bool) {
+	frontier.mt.Lock()
+	defer frontier.mt.Unlock()
+
+	for len(frontier.queue) == 0 && frontier.pending > 0 && !frontier.stopped {
+		frontier.cond.Wait()
+	}
+
+	if len(frontier.queue) == 0 || frontier.stopped {
+		return
+	}
+
+	// Take the most recent URL so the walk stays depth-first and the queue
+	// stays small
+	entry = frontier.queue[len(frontier.queue)-1]
+	frontier.queue = frontier.queue[:len(frontier.queue)-1]
+	frontier.inflight[entry] = true
+
+	return entry, true
+}
+
+// Mark an URL taken by Pop as processed
+func (frontier *Frontier) Done(entry *url.URL) {
+	frontier.mt.Lock()
+	defer frontier.mt.Unlock()
+
+	delete(frontier.inflight, entry)
+
+	frontier.pending--
+	if frontier.pending == 0 {
+		frontier.cond.Broadcast()
+	}
+}
+
+/* Mark an URL taken by Pop as processed, but remember that the turn failed.
+ * The URL stays within the saved queue, so the next turn retries it.
+ */
+func (frontier *Frontier) Fail(entry *url.URL) {
+	frontier.mt.Lock()
+	frontier.Failures++
+	frontier.failed = append(frontier.failed, entry)
+	frontier.mt.Unlock()
+
+	frontier.Done(entry)
+}
+
+/* Abort the walk. All following Pop calls return immediately. The queue is
+ * kept, so a persistent frontier continues with it on the next turn.
+ */
+func (frontier *Frontier) Stop() {
+	frontier.mt.Lock()
+	defer frontier.mt.Unlock()
+
+	frontier.stopped = true
+	frontier.cond.Broadcast()
+}
+
+/* Stop saving the state. The state of a finished turn is removed, so the next
+ * turn starts from the entry again. Unfinished turns and turns with failed URLs
+ * that are retried are saved, the next turn continues with them.
+ */
+func (frontier *Frontier) Close() (err error) {
+	if frontier.statePath == "" {
+		return
+	}
+
+	close(frontier.terminate)
+
+	if state := frontier.State(); len(state.Queue) == 0 {
+		err = os.Remove(frontier.statePath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	return frontier.save()
+}
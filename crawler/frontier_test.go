@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func useStateDir(t *testing.T) {
+	previous := *stateDir
+	*stateDir = t.TempDir()
+	t.Cleanup(func() {
+		*stateDir = previous
+	})
+}
+
+/* Walk a frontier like a crawler does. URLs are resolved against the entry,
+ * children lists the URLs found at an URL, failing the URLs that fail. Returns
+ * the visited URLs.
+ */
+func walkFrontier(t *testing.T, frontier *Frontier, children map[string][]string, failing map[string]bool) (visited []string) {
+	for {
+		entry, ok := frontier.Pop()
+		if !ok {
+			break
+		}
+
+		ref := entry.RequestURI()
+		visited = append(visited, ref)
+
+		if failing[ref] {
+			frontier.Fail(entry)
+			continue
+		}
+
+		for _, child := range children[ref] {
+			childUrl, err := url.Parse(child)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frontier.Push(frontier.Entry.ResolveReference(childUrl))
+		}
+		frontier.Done(entry)
+	}
+
+	if err := frontier.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(visited)
+	return
+}
+
+func TestFrontierFailedUrlIsRetried(t *testing.T) {
+	useStateDir(t)
+
+	entry, _ := url.Parse("http://example.com/")
+	children := map[string][]string{
+		"/":     {"/bad/", "/good/"},
+		"/bad/": {"/bad/file"},
+	}
+
+	// The failed URL is the only one visited by the next turn
+	frontier, err := CreatePersistentFrontier("test", entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	turnStart := frontier.TurnStart
+
+	visited := walkFrontier(t, frontier, children, map[string]bool{"/bad/": true})
+	if !reflect.DeepEqual(visited, []string{"/", "/bad/", "/good/"}) {
+		t.Errorf("first turn visited %q", visited)
+	}
+
+	frontier, err = CreatePersistentFrontier("test", entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !frontier.TurnStart.Equal(turnStart) {
+		t.Errorf("got turn start %s, want the one of the failed turn %s", frontier.TurnStart, turnStart)
+	}
+
+	// A successful retry completes the failed turn
+	visited = walkFrontier(t, frontier, children, nil)
+	if !reflect.DeepEqual(visited, []string{"/bad/", "/bad/file"}) {
+		t.Errorf("retry visited %q", visited)
+	}
+	if frontier.Failures != 0 {
+		t.Errorf("got %d failures after a successful retry, want none", frontier.Failures)
+	}
+}
+
+func TestFrontierFailedUrlDoesNotStopNextTurn(t *testing.T) {
+	useStateDir(t)
+
+	entry, _ := url.Parse("http://example.com/")
+	children := map[string][]string{
+		"/": {"/bad/", "/good/"},
+	}
+	failing := map[string]bool{"/bad/": true}
+	full := []string{"/", "/bad/", "/good/"}
+
+	for turn := 0; turn < 2; turn++ {
+		frontier, err := CreatePersistentFrontier("test", entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frontier.Failures != 0 {
+			t.Errorf("turn %d: a new turn starts with %d failures", turn, frontier.Failures)
+		}
+
+		visited := walkFrontier(t, frontier, children, failing)
+		if !reflect.DeepEqual(visited, full) {
+			t.Errorf("turn %d: got %q, want a full turn %q", turn, visited, full)
+		}
+
+		// The failed URL is retried once, then the next turn starts over
+		frontier, err = CreatePersistentFrontier("test", entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		visited = walkFrontier(t, frontier, children, failing)
+		if !reflect.DeepEqual(visited, []string{"/bad/"}) {
+			t.Errorf("turn %d: retry visited %q", turn, visited)
+		}
+		if frontier.Failures == 0 {
+			t.Errorf("turn %d: a failed retry has to fail the turn", turn)
+		}
+	}
+}
+
+func TestFrontierStoppedTurnIsResumed(t *testing.T) {
+	useStateDir(t)
+
+	entry, _ := url.Parse("http://example.com/")
+
+	frontier, err := CreatePersistentFrontier("test", entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, _ := frontier.Pop()
+	for _, child := range []string{"/a/", "/b/"} {
+		childUrl, _ := url.Parse(child)
+		frontier.Push(entry.ResolveReference(childUrl))
+	}
+	frontier.Done(root)
+	frontier.Stop()
+
+	visited := walkFrontier(t, frontier, nil, nil)
+	if len(visited) != 0 {
+		t.Errorf("stopped frontier visited %q", visited)
+	}
+
+	frontier, err = CreatePersistentFrontier("test", entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	visited = walkFrontier(t, frontier, nil, nil)
+	if !reflect.DeepEqual(visited, []string{"/a/", "/b/"}) {
+		t.Errorf("resumed turn visited %q", visited)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// How often files are retried before they are dropped
+const INDEXER_MAX_RETRIES = 5
+
+/* An entry of the indexer queue. Either a file to index or a flush request,
+ * which is answered with whether files of the crawler Entry failed to index.
+ */
+type indexerRequest struct {
+	File    ModelFileEntry
+	Entry   string
+	Flushed chan bool
+}
+
+/* The Indexer collects files found by all crawlers and indexes them in
+ * batches using bulk requests. A batch is sent once it is full or FlushInterval
+ * passed. The queue is bounded, so walkers block while Elasticsearch is busy
+ * instead of piling up files in memory.
+ */
+type Indexer struct {
+	Model         *Model
+	FlushSize     int
+	FlushInterval time.Duration
+
+	queue chan indexerRequest
+	batch []ModelFileEntry
+
+	// Crawler entries with files that failed to index since their last flush
+	failures map[string]bool
+}
+
+func CreateIndexer(model *Model, flushSize int, flushInterval time.Duration) (indexer *Indexer, err error) {
+	if flushSize < 1 {
+		err = fmt.Errorf("flush size has to be at least 1")
+		return
+	}
+
+	indexer = &Indexer{
+		Model:         model,
+		FlushSize:     flushSize,
+		FlushInterval: flushInterval,
+
+		// Allow to fill the next batch while the current one is sent
+		queue:    make(chan indexerRequest, flushSize),
+		failures: map[string]bool{},
+	}
+
+	go indexer.run()
+
+	return
+}
+
+func (indexer *Indexer) run() {
+	ticker := time.NewTicker(indexer.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case req := <-indexer.queue:
+			if req.Flushed != nil {
+				indexer.flush()
+
+				req.Flushed <- indexer.failures[req.Entry]
+				delete(indexer.failures, req.Entry)
+				continue
+			}
+
+			indexer.batch = append(indexer.batch, req.File)
+			if len(indexer.batch) >= indexer.FlushSize {
+				indexer.flush()
+			}
+		case <-ticker.C:
+			indexer.flush()
+		}
+	}
+}
+
+/* Send the current batch. Blocks until it got indexed or was dropped. Files
+ * rejected by an overloaded Elasticsearch are sent again, the crawler entries of
+ * files that were dropped are remembered as failed.
+ */
+func (indexer *Indexer) flush() {
+	files := indexer.batch
+	indexer.batch = nil
+
+	for attempt := 0; len(files) > 0; attempt++ {
+		retry, failed, err := indexer.Model.IndexFiles(files)
+		if err != nil {
+			retry = files
+		} else if len(retry) > 0 {
+			err = fmt.Errorf("%d files got rejected", len(retry))
+		}
+		indexer.fail(failed)
+
+		if len(retry) == 0 {
+			break
+		}
+
+		if attempt >= INDEXER_MAX_RETRIES {
+			log.Printf("dropping %d files: %s\n", len(retry), err)
+			indexer.fail(retry)
+			break
+		}
+
+		delay := Backoff(attempt)
+		log.Printf("indexing %d files failed, retrying in %s: %s\n", len(retry), delay, err)
+		time.Sleep(delay)
+
+		files = retry
+	}
+}
+
+// Remember the crawler entries of files that could not be indexed
+func (indexer *Indexer) fail(files []ModelFileEntry) {
+	for _, file := range files {
+		indexer.failures[file.Entry] = true
+	}
+}
+
+// Queue a file for indexing. Blocks while the queue is full
+func (indexer *Indexer) Add(file ModelFileEntry) {
+	indexer.queue <- indexerRequest{
+		File: file,
+	}
+}
+
+/* Wait until all files that were added before got indexed. Returns whether
+ * files of the given crawler entry failed to index since its last flush.
+ */
+func (indexer *Indexer) Flush(entry string) (failed bool) {
+	flushed := make(chan bool, 1)
+	indexer.queue <- indexerRequest{
+		Entry:   entry,
+		Flushed: flushed,
+	}
+	return <-flushed
+}
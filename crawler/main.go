@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"log"
+	"time"
 )
 
 const (
@@ -12,6 +13,11 @@ const (
 var (
 	configFile    = flag.String("c", "config.json", "Config file")
 	elasticServer = flag.String("es", "http://localhost:9200", "ElasticSearch host")
+	stateDir      = flag.String("state", "state", "Directory to store unfinished turns in, empty to disable")
+	flushSize     = flag.Int("flushSize", 500, "Maximum amount of files per bulk request")
+	flushInterval = flag.Duration("flushInterval", 5*time.Second, "Maximum time files wait for their bulk request")
+	mergeDups     = flag.Bool("mergeDuplicates", false, "Merge duplicate documents within the index and exit")
+	updateDocs    = flag.Bool("updateDocuments", false, "Index all documents again to fill fields added by an update and exit")
 )
 
 func main() {
@@ -24,7 +30,28 @@ func main() {
 		panic(err)
 	}
 
-	crawlers, err := CreateCrawlers(*configFile, model)
+	if *mergeDups {
+		err = model.MergeDuplicates()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if *updateDocs {
+		err = model.UpdateDocuments()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	indexer, err := CreateIndexer(model, *flushSize, *flushInterval)
+	if err != nil {
+		panic(err)
+	}
+
+	crawlers, err := CreateCrawlers(*configFile, model, indexer)
 	if err != nil {
 		panic(err)
 	}
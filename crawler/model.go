@@ -1,23 +1,39 @@
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"github.com/barnslig/torture/lib/elastic"
 	"log"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type ModelFileServerEntry struct {
-	Url  string
-	Path string
+	Url         string
+	Path        string
+	ArchivePath string `json:",omitempty"`
+	LastSeen    time.Time
 }
 
 type ModelFileEntry struct {
-	Filename string
-	Size     int64
-	MimeType string
-	ModTime  time.Time
-	LastSeen time.Time
-	Servers  []ModelFileServerEntry
+	Filename    string
+	Size        int64
+	MimeType    string
+	ModTime     time.Time
+	LastSeen    time.Time
+	ContentHash string `json:",omitempty"`
+	Servers     []ModelFileServerEntry
+
+	// Type detected by magic numbers, MimeType is based on the extension or
+	// reported by the server
+	SniffedMimeType string `json:",omitempty"`
+
+	// The crawler entry that found the file, only used by the indexer
+	Entry string `json:"-"`
 }
 
 type hash map[string]interface{}
@@ -26,6 +42,93 @@ type Model struct {
 	Host string
 }
 
+// Analysis settings of the index
+var indexAnalysis = hash{
+	"analyzer": hash{
+		"filename": hash{
+			"type":      "custom",
+			"tokenizer": "filename",
+			"filter":    []string{"lowercase"},
+		},
+		// Index all prefixes of filename tokens for search-as-you-type
+		"filename_prefix": hash{
+			"type":      "custom",
+			"tokenizer": "filename",
+			"filter":    []string{"lowercase", "filename_prefix"},
+		},
+	},
+	"filter": hash{
+		"filename_prefix": hash{
+			"type":     "edge_ngram",
+			"min_gram": 1,
+			"max_gram": 20,
+		},
+	},
+	"tokenizer": hash{
+		"filename": hash{
+			"type":    "pattern",
+			"pattern": "[^\\p{L}\\d]+",
+		},
+	},
+}
+
+// Mapping of file documents
+var fileMapping = hash{
+	"properties": hash{
+		"Filename": hash{
+			"type": "keyword",
+			"fields": hash{
+				"prefix": hash{
+					"type":            "text",
+					"analyzer":        "filename_prefix",
+					"search_analyzer": "filename",
+				},
+			},
+		},
+		"Size": hash{
+			"type": "long",
+		},
+		"MimeType": hash{
+			"type": "keyword",
+		},
+		"ModTime": hash{
+			"type": "date",
+		},
+		"LastSeen": hash{
+			"type": "date",
+		},
+		"ContentHash": hash{
+			"type": "keyword",
+		},
+		"SniffedMimeType": hash{
+			"type": "keyword",
+		},
+		"Servers": hash{
+			"properties": hash{
+				"Url": hash{
+					"type": "keyword",
+				},
+				"Path": hash{
+					"type":     "text",
+					"analyzer": "filename",
+					"fields": hash{
+						"keyword": hash{
+							"type": "keyword",
+						},
+					},
+				},
+				"ArchivePath": hash{
+					"type":     "text",
+					"analyzer": "filename",
+				},
+				"LastSeen": hash{
+					"type": "date",
+				},
+			},
+		},
+	},
+}
+
 func CreateModel(host string) (model *Model, err error) {
 	model = &Model{
 		Host: host,
@@ -34,124 +137,357 @@ func CreateModel(host string) (model *Model, err error) {
 	// Create mapping and index
 	_, err = elastic.Request("PUT", elastic.URL(model.Host, "/torture"), hash{
 		"settings": hash{
-			"analysis": hash{
-				"analyzer": hash{
-					"filename": hash{
-						"type":      "custom",
-						"tokenizer": "filename",
-						"filter":    []string{"lowercase"},
-					},
-				},
-				"tokenizer": hash{
-					"filename": hash{
-						"type":    "pattern",
-						"pattern": "[^\\p{L}\\d]+",
-					},
-				},
-			},
+			"analysis": indexAnalysis,
 		},
 		"mappings": hash{
-			"file": hash{
-				"properties": hash{
-					"Filename": hash{
-						"type": "keyword",
-					},
-					"Size": hash{
-						"type": "long",
-					},
-					"MimeType": hash{
-						"type": "keyword",
-					},
-					"ModTime": hash{
-						"type": "date",
-					},
-					"LastSeen": hash{
-						"type": "date",
-					},
-					"Servers": hash{
-						"properties": hash{
-							"Url": hash{
-								"type": "keyword",
-							},
-							"Path": hash{
-								"type":     "text",
-								"analyzer": "filename",
-							},
-						},
-					},
-				},
-			},
+			"file": fileMapping,
 		},
 	})
 
-	// Ignore index_already_exists_exception
+	// Indexes created by older versions might lack fields and analyzers
 	if err != nil && err.Error() == "index_already_exists_exception" {
-		err = nil
+		err = model.updateIndex()
 	}
 
 	return
 }
 
-func (model *Model) AddFileEntry(file ModelFileEntry) (err error) {
-	// Check if the file entry already exists, then count up and/or append to
-	// the servers array
-	rawRes, err := elastic.Request("GET", elastic.URL(model.Host, "/torture/file/_search"), hash{
-		"query": hash{
-			"bool": hash{
-				"must": []hash{
-					hash{
-						"term": hash{
-							"Filename": file.Filename,
-						},
-					},
-					hash{
-						"term": hash{
-							"Size": file.Size,
-						},
-					},
-				},
-			},
-		},
+/* Add new fields and analyzers to an existing index. Analyzers can only be
+ * added to a closed index, so the index is closed for a moment if the mapping
+ * refers to missing analyzers. Existing documents only get new fields indexed
+ * once they are updated, see UpdateDocuments.
+ */
+func (model *Model) updateIndex() (err error) {
+	mappingUrl := elastic.URL(model.Host, "/torture/_mapping/file")
+
+	_, err = elastic.Request("PUT", mappingUrl, fileMapping)
+	if err == nil {
+		return
+	}
+
+	log.Printf("updating the mapping failed, updating the analyzers: %s\n", err)
+
+	_, err = elastic.Request("POST", elastic.URL(model.Host, "/torture/_close"), hash{})
+	if err != nil {
+		return
+	}
+
+	_, err = elastic.Request("PUT", elastic.URL(model.Host, "/torture/_settings"), hash{
+		"analysis": indexAnalysis,
 	})
+
+	// Always open the index again, even if the settings were rejected
+	_, openErr := elastic.Request("POST", elastic.URL(model.Host, "/torture/_open"), hash{})
+	if err != nil {
+		return
+	}
+	if openErr != nil {
+		return openErr
+	}
+
+	_, err = elastic.Request("GET", elastic.URL(model.Host, "/_cluster/health/torture")+"?wait_for_status=yellow&timeout=60s", hash{})
 	if err != nil {
-		log.Println("find file error")
 		return
 	}
 
-	res, err := elastic.ParseResponse(rawRes)
+	_, err = elastic.Request("PUT", mappingUrl, fileMapping)
+	return
+}
+
+/* Index all existing documents again, so fields that were added to the
+ * mapping later on get indexed, e.g. Filename.prefix for suggestions.
+ */
+func (model *Model) UpdateDocuments() (err error) {
+	res, err := elastic.Request("POST", elastic.URL(model.Host, "/torture/_update_by_query")+"?conflicts=proceed", hash{})
 	if err != nil {
-		log.Printf("find file parse error %s\n", rawRes)
+		log.Printf("update documents error %s\n", res)
 		return
 	}
 
-	if res.Hits.Total > 0 {
-		entry := &res.Hits.Hits[0]
+	log.Printf("updated documents: %s\n", res)
+	return
+}
+
+/* The document ID of a file, based on the normalized filename and size. The
+ * ID does not depend on the content hash, so crawlers with and without
+ * hashContent store a file within the same document.
+ */
+func (file *ModelFileEntry) Id() string {
+	key := "name\x00" + strings.ToLower(file.Filename)
+
+	sum := sha1.Sum([]byte(key + "\x00" + strconv.FormatInt(file.Size, 10)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Files with the same content hash and size are the same file
+func (file *ModelFileEntry) contentKey() string {
+	return file.ContentHash + "\x00" + strconv.FormatInt(file.Size, 10)
+}
+
+/* Get the document IDs to store files within. Files are stored within the
+ * document of their ID, unless a document with the same content hash and size
+ * exists already. Renamed copies of a file are merged into that document.
+ */
+func (model *Model) documentIds(files []ModelFileEntry) (ids []string, err error) {
+	byContent := map[string]string{}
+
+	var hashes []string
+	for _, file := range files {
+		if file.ContentHash != "" {
+			hashes = append(hashes, file.ContentHash)
+		}
+	}
+
+	if len(hashes) > 0 {
+		var rawRes []byte
+		rawRes, err = elastic.Request("POST", elastic.URL(model.Host, "/torture/file/_search"), hash{
+			"size":    len(hashes),
+			"_source": []string{"ContentHash", "Size"},
+			"query": hash{
+				"terms": hash{
+					"ContentHash": hashes,
+				},
+			},
+			"collapse": hash{
+				"field": "ContentHash",
+			},
+		})
+		if err != nil {
+			return
+		}
+
+		var res elastic.Result
+		res, err = elastic.ParseResponse(rawRes)
+		if err != nil {
+			return
+		}
+
+		for _, hit := range res.Hits.Hits {
+			file := ModelFileEntry{}
+			err = json.Unmarshal(*hit.Source, &file)
+			if err != nil {
+				return
+			}
+
+			byContent[file.contentKey()] = hit.Id
+		}
+	}
+
+	for _, file := range files {
+		id := file.Id()
 
-		var updateRes []byte
-		updateRes, err = elastic.Request("POST", elastic.URL(model.Host, "/torture/file/"+entry.Id+"/_update"), hash{
+		// Copies within the same batch end up within the first one's document
+		if file.ContentHash != "" {
+			if contentId, ok := byContent[file.contentKey()]; ok {
+				id = contentId
+			} else {
+				byContent[file.contentKey()] = id
+			}
+		}
+
+		ids = append(ids, id)
+	}
+
+	return
+}
+
+/* Upsert multiple files into the documents of the given IDs using a single
+ * bulk request. Missing documents are created. Otherwise the servers are
+ * merged into the document, keeping the most recent LastSeen, and a missing
+ * content hash is added. Concurrent upserts of the same file are retried, so
+ * they always end up within one document. Items that failed are logged, err is
+ * only set if the whole request failed.
+ */
+func (model *Model) upsertFiles(files []ModelFileEntry, ids []string) (res elastic.BulkResult, err error) {
+	var lines []interface{}
+	for i, file := range files {
+		lines = append(lines, hash{
+			"update": hash{
+				"_index":             "torture",
+				"_type":              "file",
+				"_id":                ids[i],
+				"_retry_on_conflict": 3,
+			},
+		}, hash{
 			"script": hash{
-				"source": "ctx._source.LastSeen = params.LastSeen; if(!ctx._source.Servers.contains(params.Server)) { ctx._source.Servers.add(params.Server) }",
+				"source": "if (ZonedDateTime.parse(ctx._source.LastSeen).isBefore(ZonedDateTime.parse(params.LastSeen))) { ctx._source.LastSeen = params.LastSeen } if (params.ContentHash != '' && ctx._source.ContentHash == null) { ctx._source.ContentHash = params.ContentHash } for (newServer in params.Servers) { boolean found = false; for (server in ctx._source.Servers) { if (server.Url == newServer.Url && server.Path == newServer.Path && server.ArchivePath == newServer.ArchivePath) { if (server.LastSeen == null || ZonedDateTime.parse(server.LastSeen).isBefore(ZonedDateTime.parse(newServer.LastSeen))) { server.LastSeen = newServer.LastSeen } found = true } } if (!found) { ctx._source.Servers.add(newServer) } }",
 				"lang":   "painless",
 				"params": hash{
-					"LastSeen": time.Now(),
-					"Server": hash{
-						"Url":  file.Servers[0].Url,
-						"Path": file.Servers[0].Path,
-					},
+					"LastSeen":    file.LastSeen,
+					"ContentHash": file.ContentHash,
+					"Servers":     file.Servers,
 				},
 			},
+			"upsert": file,
 		})
+	}
 
-		if err != nil {
-			log.Printf("%s\n", updateRes)
+	res, err = elastic.Bulk(elastic.URL(model.Host, "/_bulk"), lines)
+	if err != nil || !res.Errors {
+		return
+	}
+
+	for _, item := range res.Items {
+		for _, action := range item {
+			if action.Error != nil {
+				log.Printf("index file %s error %s: %s\n", action.Id, action.Error.Type, action.Error.Reason)
+			}
 		}
+	}
+
+	return
+}
+
+/* Index multiple files using a single bulk request. Files that were rejected
+ * because Elasticsearch is overloaded are returned as retry, files that can
+ * not be indexed at all as failed.
+ */
+func (model *Model) IndexFiles(files []ModelFileEntry) (retry []ModelFileEntry, failed []ModelFileEntry, err error) {
+	ids, err := model.documentIds(files)
+	if err != nil {
+		return
+	}
 
+	res, err := model.upsertFiles(files, ids)
+	if err != nil || !res.Errors {
 		return
 	}
 
-	// If the file entry does not already exist, create it
-	file.LastSeen = time.Now()
-	_, err = elastic.Request("POST", elastic.URL(model.Host, "/torture/file"), file)
+	// Items are returned in the order of the request
+	for i, item := range res.Items {
+		action := item["update"]
+		switch {
+		case action.Error == nil:
+		case action.Status == http.StatusTooManyRequests || action.Status >= 500 || action.Error.Type == "es_rejected_execution_exception":
+			retry = append(retry, files[i])
+		default:
+			failed = append(failed, files[i])
+		}
+	}
+
+	return
+}
+
+/* Merge documents that are not stored under the ID of their file into the
+ * document of that ID, e.g. duplicates that were created concurrently or
+ * documents created before IDs were deterministic. Documents with the same
+ * content hash and size are merged into the first one found. Documents are
+ * only deleted after they got merged successfully.
+ */
+func (model *Model) MergeDuplicates() (err error) {
+	rawRes, err := elastic.Request("POST", elastic.URL(model.Host, "/torture/file/_search")+"?scroll=5m", hash{
+		"size": 500,
+		"sort": []string{"_doc"},
+	})
+
+	// The documents of all content hashes found so far
+	byContent := map[string]string{}
+
+	merged := 0
+	for err == nil {
+		var res elastic.Result
+		res, err = elastic.ParseResponse(rawRes)
+		if err != nil || len(res.Hits.Hits) == 0 {
+			break
+		}
+
+		var ids []string
+		var targetIds []string
+		var files []ModelFileEntry
+		for _, hit := range res.Hits.Hits {
+			file := ModelFileEntry{}
+			err = json.Unmarshal(*hit.Source, &file)
+			if err != nil {
+				return
+			}
+
+			targetId := file.Id()
+			if file.ContentHash != "" {
+				if contentId, ok := byContent[file.contentKey()]; ok {
+					targetId = contentId
+				} else {
+					byContent[file.contentKey()] = targetId
+				}
+			}
+
+			if hit.Id != targetId {
+				ids = append(ids, hit.Id)
+				targetIds = append(targetIds, targetId)
+				files = append(files, file)
+			}
+		}
+
+		if len(files) > 0 {
+			var bulkRes elastic.BulkResult
+			bulkRes, err = model.upsertFiles(files, targetIds)
+			if err != nil {
+				return
+			}
+
+			var lines []interface{}
+			for i, item := range bulkRes.Items {
+				if item["update"].Error != nil {
+					continue
+				}
+
+				lines = append(lines, hash{
+					"delete": hash{
+						"_index": "torture",
+						"_type":  "file",
+						"_id":    ids[i],
+					},
+				})
+				merged++
+			}
+
+			if len(lines) > 0 {
+				_, err = elastic.Bulk(elastic.URL(model.Host, "/_bulk"), lines)
+				if err != nil {
+					return
+				}
+			}
+		}
+
+		rawRes, err = elastic.Request("POST", elastic.URL(model.Host, "/_search/scroll"), hash{
+			"scroll":    "5m",
+			"scroll_id": res.ScrollId,
+		})
+	}
+
+	log.Printf("merged %d documents\n", merged)
+
+	return
+}
+
+/* Remove the servers below an entry from all files they were not seen with
+ * since a given time. Only servers with the URL of the entry and a path
+ * starting with pathPrefix are removed. Files without any remaining server are
+ * deleted. Servers of files that were indexed before servers had their own
+ * LastSeen count as not seen.
+ */
+func (model *Model) RemoveStaleEntry(serverUrl string, pathPrefix string, before time.Time) (err error) {
+	res, err := elastic.Request("POST", elastic.URL(model.Host, "/torture/file/_update_by_query")+"?conflicts=proceed", hash{
+		"query": hash{
+			"bool": hash{
+				"filter": []hash{
+					{"term": hash{"Servers.Url": serverUrl}},
+					{"prefix": hash{"Servers.Path.keyword": pathPrefix}},
+				},
+			},
+		},
+		"script": hash{
+			"source": "int count = ctx._source.Servers.size(); ctx._source.Servers.removeIf(server -> server.Url == params.Url && server.Path.startsWith(params.Path) && (server.LastSeen == null || ZonedDateTime.parse(server.LastSeen).toInstant().toEpochMilli() < params.Before)); if (ctx._source.Servers.isEmpty()) { ctx.op = 'delete' } else if (ctx._source.Servers.size() == count) { ctx.op = 'noop' }",
+			"lang":   "painless",
+			"params": hash{
+				"Url":    serverUrl,
+				"Path":   pathPrefix,
+				"Before": before.UnixNano() / int64(time.Millisecond),
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("remove stale files error %s\n", res)
+	}
 
 	return
 }
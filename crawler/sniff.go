@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Amount of bytes at the start of a file that are checked for magic numbers
+const SNIFF_SIZE = 512
+
+// Bytes that have to be found at an offset of a file
+type magicPart struct {
+	Offset int64
+	Magic  []byte
+}
+
+/* A file type is detected if all parts of its signature match. Check
+ * optionally verifies the head of the file for signatures that do not consist
+ * of fixed bytes.
+ */
+type magicSignature struct {
+	MimeType string
+	Parts    []magicPart
+	Check    func(head []byte) bool
+}
+
+func magic(mimeType string, offset int64, magic string, parts ...magicPart) magicSignature {
+	return magicSignature{
+		MimeType: mimeType,
+		Parts:    append([]magicPart{{offset, []byte(magic)}}, parts...),
+	}
+}
+
+/* Known file signatures. More specific signatures have to come first, e.g.
+ * QuickTime before other ISO base media files.
+ */
+var magicSignatures = []magicSignature{
+	// Archives and compressed files
+	magic("application/zip", 0, "PK\x03\x04"),
+	magic("application/zip", 0, "PK\x05\x06"),
+	magic("application/vnd.rar", 0, "Rar!\x1a\x07"),
+	magic("application/x-7z-compressed", 0, "7z\xbc\xaf\x27\x1c"),
+	magic("application/gzip", 0, "\x1f\x8b"),
+	magic("application/x-bzip2", 0, "BZh"),
+	magic("application/x-xz", 0, "\xfd7zXZ\x00"),
+	magic("application/zstd", 0, "\x28\xb5\x2f\xfd"),
+	magic("application/x-tar", 257, "ustar"),
+	magic("application/vnd.ms-cab-compressed", 0, "MSCF"),
+
+	// Disk images. ISO 9660 volume descriptors start after 32 KiB of system area,
+	// so every file of that size not matching anything else is read twice
+	magic("application/x-iso9660-image", 32769, "CD001"),
+	magic("application/x-apple-diskimage", 0, "koly"),
+
+	// Documents
+	magic("application/pdf", 0, "%PDF-"),
+	magic("application/postscript", 0, "%!PS"),
+	magic("application/rtf", 0, "{\\rtf"),
+	magic("application/x-ole-storage", 0, "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"),
+	magic("image/vnd.djvu", 0, "AT&TFORM"),
+
+	// Images
+	magic("image/png", 0, "\x89PNG\r\n\x1a\n"),
+	magic("image/jpeg", 0, "\xff\xd8\xff"),
+	magic("image/gif", 0, "GIF87a"),
+	magic("image/gif", 0, "GIF89a"),
+	magic("image/webp", 0, "RIFF", magicPart{8, []byte("WEBP")}),
+	magic("image/tiff", 0, "II*\x00"),
+	magic("image/tiff", 0, "MM\x00*"),
+
+	// Bitmaps are only recognized by the size of a known DIB header, as "BM"
+	// alone is too common
+	magic("image/bmp", 0, "BM", magicPart{14, []byte("\x0c\x00\x00\x00")}),
+	magic("image/bmp", 0, "BM", magicPart{14, []byte("\x10\x00\x00\x00")}),
+	magic("image/bmp", 0, "BM", magicPart{14, []byte("\x28\x00\x00\x00")}),
+	magic("image/bmp", 0, "BM", magicPart{14, []byte("\x34\x00\x00\x00")}),
+	magic("image/bmp", 0, "BM", magicPart{14, []byte("\x38\x00\x00\x00")}),
+	magic("image/bmp", 0, "BM", magicPart{14, []byte("\x40\x00\x00\x00")}),
+	magic("image/bmp", 0, "BM", magicPart{14, []byte("\x6c\x00\x00\x00")}),
+	magic("image/bmp", 0, "BM", magicPart{14, []byte("\x7c\x00\x00\x00")}),
+
+	// Media containers
+	magic("video/x-msvideo", 0, "RIFF", magicPart{8, []byte("AVI ")}),
+	magic("audio/wav", 0, "RIFF", magicPart{8, []byte("WAVE")}),
+	magic("video/x-matroska", 0, "\x1a\x45\xdf\xa3"),
+	magic("video/mpeg", 0, "\x00\x00\x01\xba"),
+	magic("video/mpeg", 0, "\x00\x00\x01\xb3"),
+	magic("video/x-flv", 0, "FLV\x01"),
+	magic("video/x-ms-asf", 0, "\x30\x26\xb2\x75\x8e\x66\xcf\x11"),
+	magic("audio/ogg", 0, "OggS"),
+	magic("audio/flac", 0, "fLaC"),
+	magic("audio/mpeg", 0, "ID3"),
+	magic("audio/midi", 0, "MThd"),
+
+	// ISO base media files are told apart by the major brand following "ftyp"
+	magic("video/quicktime", 4, "ftypqt  "),
+	magic("audio/mp4", 4, "ftypM4A "),
+	magic("audio/mp4", 4, "ftypM4B "),
+	magic("image/heic", 4, "ftypheic"),
+	magic("image/heic", 4, "ftypheix"),
+	magic("image/heif", 4, "ftypmif1"),
+	magic("image/heif", 4, "ftypmsf1"),
+	magic("image/avif", 4, "ftypavif"),
+	magic("image/avif", 4, "ftypavis"),
+	magic("video/3gpp", 4, "ftyp3gp"),
+	magic("video/3gpp2", 4, "ftyp3g2"),
+	magic("video/mp4", 4, "ftyp"),
+
+	// Executables
+	magic("application/x-executable", 0, "\x7fELF"),
+	{
+		MimeType: "application/x-msdownload",
+		Parts:    []magicPart{{0, []byte("MZ")}},
+		Check:    isPortableExecutable,
+	},
+}
+
+/* Whether the head of a file starting with "MZ" contains a PE header at the
+ * offset stored at 0x3c. PE headers beyond the head are not detected.
+ */
+func isPortableExecutable(head []byte) bool {
+	if len(head) < 0x40 {
+		return false
+	}
+
+	offset := int64(binary.LittleEndian.Uint32(head[0x3c:0x40]))
+	return offset+4 <= int64(len(head)) && bytes.Equal(head[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+// Whether all parts of the signature match data that was read at offset
+func (signature magicSignature) match(data []byte, offset int64) bool {
+	for _, part := range signature.Parts {
+		start := part.Offset - offset
+		end := start + int64(len(part.Magic))
+		if start < 0 || end > int64(len(data)) || !bytes.Equal(data[start:end], part.Magic) {
+			return false
+		}
+	}
+
+	// Checks only apply to the head of a file
+	if signature.Check != nil && (offset != 0 || !signature.Check(data)) {
+		return false
+	}
+
+	return true
+}
+
+// The range of a file covered by the signature
+func (signature magicSignature) bounds() (start int64, end int64) {
+	start = -1
+	for _, part := range signature.Parts {
+		if start < 0 || part.Offset < start {
+			start = part.Offset
+		}
+		if partEnd := part.Offset + int64(len(part.Magic)); partEnd > end {
+			end = partEnd
+		}
+	}
+	return
+}
+
+// Read a range of a file. Files that end early result in a short read
+func readRange(read RangeReader, offset int64, length int64) (data []byte, err error) {
+	rc, err := read(offset, length)
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+
+	data = make([]byte, length)
+	n, err := io.ReadFull(rc, data)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+
+	return data[:n], err
+}
+
+/* Detect the type of a file by its magic numbers. Only the first SNIFF_SIZE
+ * bytes are read, signatures that are located further within the file are
+ * read separately if the file is large enough and nothing matched the head,
+ * which costs another read, e.g. for ISO images. size might be negative if it
+ * is unknown. Returns an empty string if the type is unknown.
+ */
+func SniffMimeType(size int64, read RangeReader) (mimeType string, err error) {
+	headSize := int64(SNIFF_SIZE)
+	if size >= 0 && size < headSize {
+		headSize = size
+	}
+
+	head, err := readRange(read, 0, headSize)
+	if err != nil {
+		return
+	}
+
+	for _, signature := range magicSignatures {
+		if signature.match(head, 0) {
+			return signature.MimeType, nil
+		}
+	}
+
+	// Check signatures located beyond the head if the file is large enough
+	for _, signature := range magicSignatures {
+		start, end := signature.bounds()
+		if end <= int64(len(head)) || end > size {
+			continue
+		}
+
+		var data []byte
+		data, err = readRange(read, start, end-start)
+		if err != nil {
+			return
+		}
+
+		if signature.match(data, start) {
+			return signature.MimeType, nil
+		}
+	}
+
+	return
+}
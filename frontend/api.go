@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Maximum amount of results per page a client can ask for
+const apiMaxPerPage = 100
+
+/* JSON data structures of the API, version 1. Fields are only ever added to
+ * these structures, so clients can rely on them. See help.tmpl for the
+ * documentation.
+ */
+type ApiTreat struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+type ApiSearchResponse struct {
+	Query     string     `json:"query"`
+	Parsed    string     `json:"parsed"`
+	Treats    []ApiTreat `json:"treats"`
+	Sort      string     `json:"sort"`
+	Total     int        `json:"total"`
+	Page      int        `json:"page"`
+	PerPage   int        `json:"perPage"`
+	Pages     int        `json:"pages"`
+	ElapsedMs int64      `json:"elapsedMs"`
+	Prev      string     `json:"prev,omitempty"`
+	Next      string     `json:"next,omitempty"`
+
+	DidYouMean    string `json:"didYouMean,omitempty"`
+	DidYouMeanUrl string `json:"didYouMeanUrl,omitempty"`
+
+	Results []Result `json:"results"`
+	Facets  []Facet  `json:"facets"`
+}
+
+// config and instance structures
+type ApiConfig struct {
+	Frontend *Frontend
+	Search   *Search
+}
+
+type Api struct {
+	cfg ApiConfig
+}
+
+func CreateApi(cfg ApiConfig) (api *Api, err error) {
+	api = &Api{cfg: cfg}
+	return
+}
+
+func (api *Api) SearchHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	/* Parse GET parameters, see Search.Do
+	 * pp: Results per page, at most apiMaxPerPage
+	 */
+	perPage, err := strconv.Atoi(r.FormValue("pp"))
+	if err != nil || perPage < 1 {
+		perPage = api.cfg.Frontend.cfg.PerPage
+	}
+	if perPage > apiMaxPerPage {
+		perPage = apiMaxPerPage
+	}
+
+	res, err := api.cfg.Search.Do(r, perPage)
+	if _, isParseError := err.(*ParseError); isParseError {
+		api.writeJson(w, http.StatusBadRequest, JsonError{
+			Error: err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	out := ApiSearchResponse{
+		Query:     res.Query,
+		Parsed:    res.Stmt.Root.String(),
+		Treats:    []ApiTreat{},
+		Sort:      res.Order.Param(),
+		Total:     res.Response.Hits.Total,
+		Page:      res.Page,
+		PerPage:   res.PerPage,
+		Pages:     res.Pages,
+		ElapsedMs: int64(res.Elapsed / time.Millisecond),
+		Results:   res.Results,
+		Facets:    res.Facets,
+
+		DidYouMean:    res.DidYouMean,
+		DidYouMeanUrl: res.DidYouMeanUrl,
+	}
+
+	for _, treat := range res.Stmt.Treats {
+		out.Treats = append(out.Treats, ApiTreat{
+			Key:      treat.Key.String(),
+			Operator: treat.Operator.String(),
+			Value:    treat.Value,
+		})
+	}
+
+	if out.Results == nil {
+		out.Results = []Result{}
+	}
+	if out.Facets == nil {
+		out.Facets = []Facet{}
+	}
+
+	if res.Page > 0 {
+		out.Prev = getApiPageLink(res.Page-1, res.PerPage, r.URL)
+	}
+	if res.Page+1 < res.Pages {
+		out.Next = getApiPageLink(res.Page+1, res.PerPage, r.URL)
+	}
+
+	api.writeJson(w, http.StatusOK, out)
+}
+
+func (api *Api) writeJson(w http.ResponseWriter, status int, data interface{}) {
+	output, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(output)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Like getPageLink, but also keeps the amount of results per page
+func getApiPageLink(page int, perPage int, inURL *url.URL) string {
+	linkURL, _ := url.Parse(getPageLink(page, inURL))
+
+	qry := linkURL.Query()
+	qry.Set("pp", strconv.Itoa(perPage))
+	linkURL.RawQuery = qry.Encode()
+
+	return linkURL.String()
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/barnslig/torture/lib/elastic"
 	"github.com/dustin/go-humanize"
 	"regexp"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type ElasticSearch struct {
@@ -14,141 +18,479 @@ type ElasticSearch struct {
 
 type hash map[string]interface{}
 
+// Highlighted parts of a path are enclosed by these control characters. They
+// are replaced by HTML tags after escaping the path, see highlightServers.
+const (
+	highlightPreTag  = "\x01"
+	highlightPostTag = "\x02"
+)
+
 func CreateElasticSearch(host string) (es *ElasticSearch, err error) {
 	es = &ElasticSearch{url: host}
 	return
 }
 
-func (es *ElasticSearch) Search(stmt Statement, perPage int, page int) (result elastic.Result, err error) {
-	query := strings.Join(stmt.Phrases, " ")
-
-	filterQ := []hash{}
-	for _, treat := range stmt.Treats {
-
-		// Filter for file extensions, e.g. extension:pdf or extension!mkv
-		if treat.Key == keyExtension {
-			regex := ""
-			switch treat.Operator {
-			case EQUALS:
-				regex = fmt.Sprintf(`.+.%s`, ExtractRegexSave(treat.Value))
-				break
-			case NOT:
-				regex = fmt.Sprintf(`@&~(.+.%s)`, ExtractRegexSave(treat.Value))
-				break
-			default:
-				continue
-			}
+func (es *ElasticSearch) Search(stmt Statement, order SortOrder, perPage int, page int) (result elastic.Result, err error) {
+	query, err := CompileQuery(stmt.Root)
+	if err != nil {
+		return
+	}
+	if query == nil {
+		query = matchAllQuery()
+	}
 
-			filterQ = append(filterQ, hash{
-				"regexp": hash{
-					"Filename": regex,
+	data, err := elastic.Request("POST", elastic.URL(es.url, "/torture/file/_search"), hash{
+		"size": perPage,
+		"from": perPage * page,
+		"sort": order.Query(),
+		"aggs": FacetAggregationsQuery(),
+		"highlight": hash{
+			"pre_tags":  []string{highlightPreTag},
+			"post_tags": []string{highlightPostTag},
+			"fields": hash{
+				// Return the complete paths instead of fragments
+				"Servers.Path": hash{
+					"number_of_fragments": 0,
+				},
+			},
+		},
+		"query": hash{
+			"function_score": hash{
+				"query": query,
+				"field_value_factor": hash{
+					"field":    "Size",
+					"missing":  1,
+					"modifier": "log1p",
+					"factor":   0.000000001, // Increase Bytes to Gigabytes
 				},
-			})
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+
+	result, err = elastic.ParseResponse(data)
+
+	return
+}
+
+// Find distinct filenames starting with the words of a text, used for
+// search-as-you-type
+func (es *ElasticSearch) Suggest(text string, size int) (filenames []string, err error) {
+	data, err := elastic.Request("POST", elastic.URL(es.url, "/torture/file/_search"), hash{
+		"size":    size,
+		"_source": []string{"Filename"},
+		"query": hash{
+			"match": hash{
+				"Filename.prefix": hash{
+					"query":    text,
+					"operator": "and",
+				},
+			},
+		},
+		"collapse": hash{
+			"field": "Filename",
+		},
+	})
+	if err != nil {
+		return
+	}
+
+	result, err := elastic.ParseResponse(data)
+	if err != nil {
+		return
+	}
+
+	for _, hit := range result.Hits.Hits {
+		var file struct {
+			Filename string
 		}
+		err = unmarshalRawJson(hit.Source, &file)
+		if err != nil {
+			return
+		}
+
+		filenames = append(filenames, file.Filename)
+	}
+
+	return
+}
+
+/* Compile a node of the query AST into an Elasticsearch query. Phrases are
+ * scored, treats are only used as filters. Returns nil if the node does not
+ * restrict the results at all, e.g. if it only consists of sort treats.
+ * Invalid treats are rejected by TreatParser already, err is only set if the
+ * AST was built otherwise.
+ */
+func CompileQuery(node Node) (query hash, err error) {
+	switch n := node.(type) {
+	case Phrase:
+		if n.Exact {
+			return exactPhraseQuery(n.Value), nil
+		}
+		return phraseQuery([]string{n.Value}), nil
+
+	case Treat:
+		// Sorting is not a filter, see SortOrder
+		if n.Key == keySort {
+			return nil, nil
+		}
+		return TreatQuery(n)
+
+	case Not:
+		var inner hash
+		inner, err = CompileQuery(n.Node)
+		if inner == nil || err != nil {
+			return
+		}
+		query = hash{
+			"bool": hash{
+				"must":     matchAllQuery(),
+				"must_not": inner,
+			},
+		}
+		return
 
-		// Filter for size, e.g. size>1gb or size<20mb
-		if treat.Key == keySize {
-			// Try to parse the given size
-			size, err := humanize.ParseBytes(treat.Value)
+	case Or:
+		shouldQ := []hash{}
+		for _, child := range n {
+			var childQ hash
+			childQ, err = CompileQuery(child)
 			if err != nil {
-				continue
+				return
 			}
 
-			rangeQ := hash{}
-			switch treat.Operator {
-			case LTE:
-				rangeQ = hash{
-					"lte": size,
+			// An unrestricted operand makes the whole OR unrestricted
+			if childQ == nil {
+				return nil, nil
+			}
+			shouldQ = append(shouldQ, childQ)
+		}
+		query = hash{
+			"bool": hash{
+				"should":               shouldQ,
+				"minimum_should_match": 1,
+			},
+		}
+		return
+
+	case And:
+		var phrases []string
+		mustQ := []hash{}
+		filterQ := []hash{}
+		mustNotQ := []hash{}
+		for _, child := range n {
+			switch c := child.(type) {
+			case Phrase:
+				// Unquoted phrases are searched at once
+				if !c.Exact {
+					phrases = append(phrases, c.Value)
+					continue
+				}
+			case Treat:
+				var childQ hash
+				childQ, err = CompileQuery(c)
+				if err != nil {
+					return
+				}
+				if childQ != nil {
+					filterQ = append(filterQ, childQ)
+				}
+				continue
+			case Not:
+				var childQ hash
+				childQ, err = CompileQuery(c.Node)
+				if err != nil {
+					return
 				}
-				break
-			case GTE:
-				rangeQ = hash{
-					"gte": size,
+				if childQ != nil {
+					mustNotQ = append(mustNotQ, childQ)
 				}
-			default:
 				continue
 			}
 
-			filterQ = append(filterQ, hash{
-				"range": hash{
-					"Size": rangeQ,
-				},
-			})
-		}
-
-		// Filter for media types, e.g. type:video, type:audio
-		if treat.Key == keyType {
-			endingsRegex := "*"
-			switch treat.Value {
-			case "video":
-				endingsRegex = "(webm|mkv|flv|vob|ogv|avi|mov|wmv|mp4|mpg|mpeg|m4v|3gp|mts)"
-				break
-			case "audio":
-				endingsRegex = "(aac|aiff|amr|flac|m4a|mp3|ogg|oga|opus|wav|wma)"
-				break
-			case "image":
-				endingsRegex = "(jpg|jpeg|tiff|gif|bmp|png|webp|psd|xcf|svg|ai)"
-				break
-			case "document":
-				endingsRegex = "(epub|doc|docx|html|tex|ibooks|azw|mobi|pdf|txt|ps|rtf|xps|odt)"
-				break
-			default:
-				continue
+			var childQ hash
+			childQ, err = CompileQuery(child)
+			if err != nil {
+				return
 			}
+			if childQ != nil {
+				mustQ = append(mustQ, childQ)
+			}
+		}
 
-			regex := ""
-			switch treat.Operator {
-			case EQUALS:
-				regex = fmt.Sprintf(`.+.%s`, endingsRegex)
-				break
-			case NOT:
-				regex = fmt.Sprintf(`@&~(.+.%s)`, endingsRegex)
-				break
-			default:
-				continue
+		if len(phrases) > 0 {
+			mustQ = append(mustQ, phraseQuery(phrases))
+		}
+
+		if len(mustQ)+len(filterQ)+len(mustNotQ) == 0 {
+			return
+		}
+
+		// Filters give a score of 0, which would break the size boost
+		if len(mustQ) == 0 {
+			mustQ = append(mustQ, matchAllQuery())
+		}
+
+		query = hash{
+			"bool": hash{
+				"must":     mustQ,
+				"filter":   filterQ,
+				"must_not": mustNotQ,
+			},
+		}
+	}
+
+	return
+}
+
+func matchAllQuery() hash {
+	return hash{
+		"match_all": hash{},
+	}
+}
+
+// Search for phrases within the file path
+func phraseQuery(phrases []string) hash {
+	return hash{
+		"simple_query_string": hash{
+			"fields":           []string{"Servers.Path"},
+			"default_operator": "AND",
+			"query":            strings.Join(phrases, " "),
+		},
+	}
+}
+
+// Search for a quoted phrase within the file path. All words have to appear
+// next to each other and in the given order.
+func exactPhraseQuery(phrase string) hash {
+	return hash{
+		"match_phrase": hash{
+			"Servers.Path": phrase,
+		},
+	}
+}
+
+// Create an Elasticsearch filter query for a single treat
+func TreatQuery(treat Treat) (query hash, err error) {
+	switch treat.Key {
+
+	// Filter for file extensions, e.g. extension:pdf or extension!mkv
+	case keyExtension:
+		regex := ""
+		switch treat.Operator {
+		case EQUALS:
+			regex = fmt.Sprintf(`.+.%s`, ExtractRegexSave(treat.Value))
+			break
+		case NOT:
+			regex = fmt.Sprintf(`@&~(.+.%s)`, ExtractRegexSave(treat.Value))
+			break
+		default:
+			err = fmt.Errorf("unsupported operator for %s", treat)
+			return
+		}
+
+		query = hash{
+			"regexp": hash{
+				"Filename": regex,
+			},
+		}
+
+	// Filter for size, e.g. size>1gb or size<20mb
+	case keySize:
+		// Try to parse the given size
+		var size uint64
+		size, err = humanize.ParseBytes(treat.Value)
+		if err != nil {
+			return
+		}
+
+		rangeQ := hash{}
+		switch treat.Operator {
+		case LTE:
+			rangeQ = hash{
+				"lte": size,
+			}
+			break
+		case GTE:
+			rangeQ = hash{
+				"gte": size,
 			}
+		default:
+			err = fmt.Errorf("unsupported operator for %s", treat)
+			return
+		}
+
+		query = hash{
+			"range": hash{
+				"Size": rangeQ,
+			},
+		}
+
+	// Filter for media types, e.g. type:video, type:audio
+	case keyType:
+		endingsRegex := "*"
+		switch treat.Value {
+		case "video":
+			endingsRegex = "(webm|mkv|flv|vob|ogv|avi|mov|wmv|mp4|mpg|mpeg|m4v|3gp|mts)"
+			break
+		case "audio":
+			endingsRegex = "(aac|aiff|amr|flac|m4a|mp3|ogg|oga|opus|wav|wma)"
+			break
+		case "image":
+			endingsRegex = "(jpg|jpeg|tiff|gif|bmp|png|webp|psd|xcf|svg|ai)"
+			break
+		case "document":
+			endingsRegex = "(epub|doc|docx|html|tex|ibooks|azw|mobi|pdf|txt|ps|rtf|xps|odt)"
+			break
+		default:
+			err = fmt.Errorf("unknown type %s", treat.Value)
+			return
+		}
+
+		regex := ""
+		switch treat.Operator {
+		case EQUALS:
+			regex = fmt.Sprintf(`.+.%s`, endingsRegex)
+			break
+		case NOT:
+			regex = fmt.Sprintf(`@&~(.+.%s)`, endingsRegex)
+			break
+		default:
+			err = fmt.Errorf("unsupported operator for %s", treat)
+			return
+		}
+
+		query = hash{
+			"regexp": hash{
+				"Filename": regex,
+			},
+		}
+
+	// Filter for dates, e.g. modified>2023-12-01, modified<3d or seen<1h
+	case keyModified, keySeen:
+		field := "ModTime"
+		if treat.Key == keySeen {
+			field = "LastSeen"
+		}
+
+		var rangeQ hash
+		rangeQ, err = DateRange(treat.Operator, treat.Value)
+		if err != nil {
+			return
+		}
+
+		query = hash{
+			"range": hash{
+				field: rangeQ,
+			},
+		}
 
-			filterQ = append(filterQ, hash{
+	// Filter for servers, e.g. server:ftp.gnu.org, server!10.0.* or
+	// server:ftp://10.0.0.1:2121
+	case keyServer:
+		// Servers.Url has multiple values, so the complement matches every file
+		// that is on at least one other server. The matching servers are hidden
+		// by filterServers. Use -server:... to exclude files on a server at all.
+		switch treat.Operator {
+		case EQUALS:
+			query = hash{
 				"regexp": hash{
-					"Filename": regex,
+					"Servers.Url": ServerRegex(treat.Value),
 				},
-			})
+			}
+			break
+		case NOT:
+			query = hash{
+				"regexp": hash{
+					"Servers.Url": hash{
+						"value": "~(" + ServerRegex(treat.Value) + ")",
+						"flags": "COMPLEMENT",
+					},
+				},
+			}
+			break
+		default:
+			err = fmt.Errorf("unsupported operator for %s", treat)
+			return
 		}
 
+	// Sorting is not a filter, see SortOrder
+	case keySort:
+		err = fmt.Errorf("%s is not a filter", treat)
+
+	default:
+		err = fmt.Errorf("unknown treat %s", treat)
 	}
 
-	data, err := elastic.Request("POST", elastic.URL(es.url, "/torture/file/_search"), hash{
-		"size": perPage,
-		"from": perPage * page,
-		"query": hash{
-			"bool": hash{
-				"must": hash{
-					"function_score": hash{
-						"query": hash{
-							"simple_query_string": hash{
-								"fields":           []string{"Servers.Path"},
-								"default_operator": "AND",
-								"query":            query,
-							},
-						},
-						"field_value_factor": hash{
-							"field":    "Size",
-							"missing":  1,
-							"modifier": "log1p",
-							"factor":   0.000000001, // Increase Bytes to Gigabytes
-						},
-					},
-				},
-				"filter": filterQ,
-			},
-		},
-	})
-	if err != nil {
+	return
+}
+
+// Layouts accepted by absolute date treats, from most to least precise
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Relative date treats, e.g. 30m, 3d or 2w. The units match the ones of the
+// Elasticsearch date math, with m being minutes.
+var relativeDateRegex = regexp.MustCompile(`^(\d+)([smhdwy])$`)
+
+/* Create an Elasticsearch range query for a date treat. The value is either
+ * an absolute date like 2023-12-01 or a relative age like 3d. Relative values
+ * compare the age of a file, so modified<3d means "modified less than three
+ * days ago" and modified>3d means "modified more than three days ago".
+ *
+ * A date without time combined with EQUALS matches the whole day.
+ */
+func DateRange(operator Operator, value string) (rangeQ hash, err error) {
+	// Relative age, handled by Elasticsearch date math
+	if m := relativeDateRegex.FindStringSubmatch(value); m != nil {
+		bound := fmt.Sprintf("now-%s%s", m[1], m[2])
+
+		switch operator {
+		case LTE:
+			rangeQ = hash{"gte": bound}
+		case GTE:
+			rangeQ = hash{"lte": bound}
+		default:
+			err = fmt.Errorf("unsupported operator for relative date %s", value)
+		}
 		return
 	}
 
-	result, err = elastic.ParseResponse(data)
+	// Absolute date
+	for _, layout := range dateLayouts {
+		date, pErr := time.ParseInLocation(layout, value, time.Local)
+		if pErr != nil {
+			continue
+		}
+
+		switch operator {
+		case LTE:
+			rangeQ = hash{"lte": date.Format(time.RFC3339)}
+		case GTE:
+			rangeQ = hash{"gte": date.Format(time.RFC3339)}
+		case EQUALS:
+			if layout != "2006-01-02" {
+				err = fmt.Errorf("only whole days can be matched exactly: %s", value)
+				return
+			}
+			rangeQ = hash{
+				"gte": date.Format(time.RFC3339),
+				"lt":  date.AddDate(0, 0, 1).Format(time.RFC3339),
+			}
+		default:
+			err = fmt.Errorf("unsupported operator for date %s", value)
+		}
+		return
+	}
 
+	err = fmt.Errorf("invalid date: %s", value)
 	return
 }
 
@@ -157,3 +499,42 @@ func ExtractRegexSave(src string) string {
 	r := regexp.MustCompile(`\w+`)
 	return strings.Join(r.FindAllString(src, -1), "")
 }
+
+/* Turn a server treat value into a regex matching Servers.Url. The value may
+ * be a plain host or a full URL and may contain the wildcards * and ?. If no
+ * scheme is given, any scheme, user info and port is accepted.
+ *
+ * The result is valid for both Lucene and Go regexes as all other special
+ * characters are escaped using a backslash.
+ *
+ * Example:
+ *   ServerRegex("10.0.*") --> ([a-z0-9+.\-]+://)?([^\@/]*\@)?10\.0\..*(:[0-9]+)?
+ */
+func ServerRegex(value string) string {
+	var regex bytes.Buffer
+
+	hasScheme := strings.Contains(value, "://")
+	if !hasScheme {
+		regex.WriteString(`([a-z0-9+.\-]+://)?([^\@/]*\@)?`)
+	}
+
+	for _, ch := range strings.TrimSuffix(value, "/") {
+		switch {
+		case ch == '*':
+			regex.WriteString(".*")
+		case ch == '?':
+			regex.WriteString(".")
+		case ch < utf8.RuneSelf && !unicode.IsLetter(ch) && !unicode.IsDigit(ch):
+			regex.WriteRune('\\')
+			regex.WriteRune(ch)
+		default:
+			regex.WriteRune(ch)
+		}
+	}
+
+	if !hasScheme {
+		regex.WriteString("(:[0-9]+)?")
+	}
+
+	return regex.String()
+}
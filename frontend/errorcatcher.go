@@ -5,6 +5,7 @@ import (
 	"github.com/flosch/pongo2"
 	"github.com/julienschmidt/httprouter"
 	"net/http"
+	"strings"
 )
 
 type JsonError struct {
@@ -47,6 +48,11 @@ func (errorCatcher *ErrorCatcher) Handler(h httprouter.Handle) httprouter.Handle
 				 */
 				format := r.FormValue("format")
 
+				// The API always speaks JSON
+				if strings.HasPrefix(r.URL.Path, "/api/") {
+					format = "json"
+				}
+
 				if format == "json" {
 					output, err := json.Marshal(JsonError{
 						Error: err.Error(),
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/barnslig/torture/lib/elastic"
+	"net/url"
+)
+
+// Values of the type treat, in the order they are shown as facets
+var fileTypes = []string{"video", "audio", "image", "document"}
+
+// Amount of buckets per terms facet
+const facetSize = 10
+
+// JSON data structures
+type FacetBucket struct {
+	Key      string      `json:"key"`
+	DocCount json.Number `json:"doc_count"`
+}
+
+type FacetTerms struct {
+	Buckets []FacetBucket `json:"buckets"`
+}
+
+type FacetFilters struct {
+	Buckets map[string]FacetBucket `json:"buckets"`
+}
+
+type FacetAggregations struct {
+	ByType      FacetFilters `json:"by_type"`
+	ByExtension FacetTerms   `json:"by_extension"`
+	ByServer    FacetTerms   `json:"by_server"`
+}
+
+// view data structures
+type FacetValue struct {
+	Value  string `json:"value"`
+	Count  uint64 `json:"count"`
+	Treat  string `json:"treat"`
+	Url    string `json:"url"`
+	Active bool   `json:"active"`
+}
+
+type Facet struct {
+	Name   string       `json:"name"`
+	Values []FacetValue `json:"values"`
+}
+
+// Create the aggregations needed for the facets of a search
+func FacetAggregationsQuery() hash {
+	typeFilters := hash{}
+	for _, fileType := range fileTypes {
+		typeFilters[fileType], _ = TreatQuery(Treat{Key: keyType, Operator: EQUALS, Value: fileType})
+	}
+
+	return hash{
+		"by_type": hash{
+			"filters": hash{
+				"filters": typeFilters,
+			},
+		},
+		"by_extension": hash{
+			"terms": hash{
+				"size": facetSize,
+				"script": hash{
+					"lang":   "painless",
+					"source": "String name = doc['Filename'].value; int dot = name.lastIndexOf('.'); return dot < 1 ? '' : name.substring(dot + 1);",
+				},
+				"exclude": "",
+			},
+		},
+		"by_server": hash{
+			"terms": hash{
+				"size":  facetSize,
+				"field": "Servers.Url",
+			},
+		},
+	}
+}
+
+/* Turn the aggregations of a search result into facets. Every facet value
+ * links to the current query with the matching treat added.
+ */
+func ParseFacets(result elastic.Result, stmt Statement, inURL *url.URL) (facets []Facet, err error) {
+	if result.Aggregations == nil {
+		return
+	}
+
+	aggs := FacetAggregations{}
+	err = json.Unmarshal(*result.Aggregations, &aggs)
+	if err != nil {
+		return
+	}
+
+	typeFacet := Facet{Name: "Type"}
+	for _, fileType := range fileTypes {
+		bucket := aggs.ByType.Buckets[fileType]
+		bucket.Key = fileType
+		typeFacet.Values = appendFacetValue(typeFacet.Values, bucket, keyType, stmt, inURL)
+	}
+
+	extensionFacet := Facet{Name: "Extension"}
+	for _, bucket := range aggs.ByExtension.Buckets {
+		extensionFacet.Values = appendFacetValue(extensionFacet.Values, bucket, keyExtension, stmt, inURL)
+	}
+
+	serverFacet := Facet{Name: "Server"}
+	for _, bucket := range aggs.ByServer.Buckets {
+		serverFacet.Values = appendFacetValue(serverFacet.Values, bucket, keyServer, stmt, inURL)
+	}
+
+	for _, facet := range []Facet{typeFacet, extensionFacet, serverFacet} {
+		if len(facet.Values) > 0 {
+			facets = append(facets, facet)
+		}
+	}
+
+	return
+}
+
+// Append a bucket to a list of facet values, skipping empty buckets
+func appendFacetValue(values []FacetValue, bucket FacetBucket, key Key, stmt Statement, inURL *url.URL) []FacetValue {
+	count, _ := bucket.DocCount.Int64()
+	if count == 0 {
+		return values
+	}
+
+	treat := Treat{Key: key, Operator: EQUALS, Value: bucket.Key}
+
+	// A treat the query already requires does not change the results
+	active := false
+	for _, stmtTreat := range stmt.Treats {
+		if stmtTreat == treat {
+			active = true
+		}
+	}
+
+	return append(values, FacetValue{
+		Value:  bucket.Key,
+		Count:  uint64(count),
+		Treat:  treat.String(),
+		Url:    getTreatLink(treat, stmt, inURL),
+		Active: active,
+	})
+}
+
+// Create a link to the current query with a treat added to it
+func getTreatLink(treat Treat, stmt Statement, inURL *url.URL) string {
+	var root And
+	switch n := stmt.Root.(type) {
+	case And:
+		root = append(root, n...)
+	default:
+		root = And{n}
+	}
+	root = append(root, treat)
+
+	return getQueryLink(root.String(), inURL)
+}
+
+// Create a link to the first page of another query
+func getQueryLink(query string, inURL *url.URL) string {
+	qry := inURL.Query()
+	qry.Set("q", query)
+	qry.Del("p")
+
+	linkURL := *inURL
+	linkURL.RawQuery = qry.Encode()
+
+	return linkURL.String()
+}
@@ -68,10 +68,27 @@ func CreateFrontend(cfg FrontendConfig) (frontend *Frontend, err error) {
 		return
 	}
 
+	suggest, err := CreateSuggest(SuggestConfig{
+		Frontend: frontend,
+	})
+	if err != nil {
+		return
+	}
+
+	api, err := CreateApi(ApiConfig{
+		Frontend: frontend,
+		Search:   search,
+	})
+	if err != nil {
+		return
+	}
+
 	mux := httprouter.New()
 	mux.Handle("GET", "/s", errorCatcher.Handler(search.Handler))
 	mux.Handle("GET", "/help", errorCatcher.Handler(help.Handler))
 	mux.Handle("GET", "/servers", errorCatcher.Handler(servers.Handler))
+	mux.Handle("GET", "/api/v1/search", errorCatcher.Handler(api.SearchHandler))
+	mux.Handle("GET", "/api/suggest", errorCatcher.Handler(suggest.Handler))
 	mux.Handler("GET", "/", http.RedirectHandler("/s", 301))
 	mux.ServeFiles("/static/*filepath", http.Dir("static"))
 
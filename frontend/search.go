@@ -2,26 +2,69 @@ package main
 
 import (
 	"encoding/json"
+	"github.com/barnslig/torture/lib/elastic"
 	"github.com/dustin/go-humanize"
 	"github.com/flosch/pongo2"
 	"github.com/julienschmidt/httprouter"
+	"html"
 	"net/http"
 	"net/url"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 )
 
 type Server struct {
-	Url  string
-	Path string
+	Url  string `json:"url"`
+	Path string `json:"path"`
+
+	// Path within the archive at Path, if the file is part of an archive
+	ArchivePath string `json:"archivePath,omitempty"`
+
+	// HTML of the path with the matching parts enclosed in <mark> tags. Only
+	// set if the path matched the query.
+	HighlightedPath string `json:"highlightedPath,omitempty"`
 }
 
+// The JSON field names only differ in case from the index, so the same
+// struct is used to read the index and to write the API response.
 type Result struct {
-	Servers   []Server
-	Filename  string
-	Size      uint64
-	HumanSize string
+	Servers   []Server  `json:"servers"`
+	Filename  string    `json:"filename"`
+	Size      uint64    `json:"size"`
+	HumanSize string    `json:"humanSize"`
+	MimeType  string    `json:"mimeType"`
+	ModTime   time.Time `json:"modTime"`
+	LastSeen  time.Time `json:"lastSeen"`
+
+	// Names of the same file on other servers, known from content hashing
+	OtherNames []string `json:"otherNames,omitempty"`
+}
+
+// The hits are embedded so the facets are just an additional field
+type JsonResults struct {
+	elastic.Hits
+	Facets []Facet `json:"facets"`
+}
+
+// A search parsed from the GET parameters, together with its results
+type SearchResults struct {
+	Query    string
+	Stmt     Statement
+	Order    SortOrder
+	Page     int
+	PerPage  int
+	Pages    int
+	Response elastic.Result
+	Results  []Result
+	Facets   []Facet
+	Elapsed  time.Duration
+
+	// Corrected query if nothing was found
+	DidYouMean    string
+	DidYouMeanUrl string
 }
 
 type SearchConfig struct {
@@ -45,35 +88,101 @@ func CreateSearch(cfg SearchConfig) (search *Search, err error) {
 	return
 }
 
-func (search *Search) Handler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+/* Parse GET parameters and do the search. Invalid queries result in a
+ * *ParseError.
+ * q: Search query
+ * p: Current page, starting at zero. Is zero if not a number
+ * sort: Sort order, e.g. size, size-asc or name-desc. Default is relevance
+ */
+func (search *Search) Do(r *http.Request, perPage int) (res SearchResults, err error) {
 	start := time.Now()
 
-	/* Parse GET parameters
-	 * q: Search query
-	 * p: Current page. Is zero if not a number
-	 * f: Filter. Can be used multiple times
-	 * format: Format. Default is HTML, currently supported options: "json"
-	 */
-	query := r.FormValue("q")
-	format := r.FormValue("format")
-	page, err := strconv.Atoi(r.FormValue("p"))
+	res.Query = r.FormValue("q")
+	res.PerPage = perPage
+	res.Page, err = strconv.Atoi(r.FormValue("p"))
+	if err != nil || res.Page < 0 {
+		res.Page = 0
+	}
+
+	res.Stmt, err = TreatParser(strings.NewReader(res.Query))
 	if err != nil {
-		page = 0
+		return
+	}
+
+	res.Order = GetSortOrder(r.FormValue("sort"), res.Stmt)
+
+	// Do the actual search. An empty query has no results
+	if strings.TrimSpace(res.Query) != "" {
+		res.Response, err = search.cfg.Frontend.elasticSearch.Search(res.Stmt, res.Order, res.PerPage, res.Page)
+		if err != nil {
+			return
+		}
+	}
+	res.Pages = (res.Response.Hits.Total + res.PerPage - 1) / res.PerPage
+
+	// Typos are common, so try to correct queries without results
+	if strings.TrimSpace(res.Query) != "" && res.Response.Hits.Total == 0 {
+		// Suggestions are optional, so failing to get them is not an error
+		var dErr error
+		res.DidYouMean, dErr = search.cfg.Frontend.elasticSearch.DidYouMean(res.Stmt)
+		if dErr != nil {
+			search.cfg.Frontend.Log.Printf("did you mean: %s\n", dErr)
+		}
+		if res.DidYouMean != "" {
+			res.DidYouMeanUrl = getQueryLink(res.DidYouMean, r.URL)
+		}
 	}
 
-	r.ParseForm()
+	res.Facets, err = ParseFacets(res.Response, res.Stmt, r.URL)
+	if err != nil {
+		return
+	}
 
-	stmt := TreatParser(strings.NewReader(query))
+	for _, qr := range res.Response.Hits.Hits {
+		// Parse the search result into a Result struct
+		var result Result
+		err = unmarshalRawJson(qr.Source, &result)
+		if err != nil {
+			return
+		}
+
+		// Only list the servers matching the server treats
+		result.Servers = filterServers(result.Servers, res.Stmt)
+		highlightServers(result.Servers, qr.Highlight["Servers.Path"])
+
+		result.OtherNames = otherNames(result.Filename, result.Servers)
+
+		// Humanize the file size
+		result.HumanSize = humanize.Bytes(result.Size)
+		res.Results = append(res.Results, result)
+	}
 
-	// Do the actual search
-	resp, err := search.cfg.Frontend.elasticSearch.Search(stmt, search.cfg.Frontend.cfg.PerPage, page)
+	res.Elapsed = time.Since(start)
+
+	return
+}
+
+func (search *Search) Handler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	/* Parse GET parameters, see Do
+	 * format: Format. Default is HTML, currently supported options: "json"
+	 */
+	format := r.FormValue("format")
+
+	res, err := search.Do(r, search.cfg.Frontend.cfg.PerPage)
+	if _, isParseError := err.(*ParseError); isParseError {
+		search.invalidQuery(w, format, res.Query, err)
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
 
-	// Format: JSON
+	// Format: JSON. Deprecated in favor of the API, see api.go
 	if format == "json" {
-		output, err := json.Marshal(resp.Hits)
+		output, err := json.Marshal(JsonResults{
+			Hits:   res.Response.Hits,
+			Facets: res.Facets,
+		})
 		if err != nil {
 			panic(err)
 		}
@@ -88,32 +197,51 @@ func (search *Search) Handler(w http.ResponseWriter, r *http.Request, params htt
 	}
 
 	// Format: HTML (default)
-	var results []Result
-	for _, qr := range resp.Hits.Hits {
-		// Parse the search result into a Result struct
-		var result Result
-		err := unmarshalRawJson(qr.Source, &result)
+	search.tmpl.ExecuteWriter(pongo2.Context{
+		"query": res.Query,
+
+		"page":     res.Page,
+		"frompage": res.PerPage * res.Page,
+		"maxpages": res.Response.Hits.Total / res.PerPage,
+		"prevpage": getPageLink(res.Page-1, r.URL),
+		"nextpage": getPageLink(res.Page+1, r.URL),
+
+		"sortlinks": getSortLinks(res.Order, r.URL),
+		"facets":    res.Facets,
+
+		"didyoumean":    res.DidYouMean,
+		"didyoumeanurl": res.DidYouMeanUrl,
+
+		"elapsed":  res.Elapsed / time.Millisecond,
+		"response": res.Response,
+		"results":  res.Results,
+	}, w)
+}
+
+// Tell the user that the query could not be parsed
+func (search *Search) invalidQuery(w http.ResponseWriter, format string, query string, parseErr error) {
+	if format == "json" {
+		output, err := json.Marshal(JsonError{
+			Error: parseErr.Error(),
+		})
 		if err != nil {
 			panic(err)
 		}
 
-		// Humanize the file size
-		result.HumanSize = humanize.Bytes(result.Size)
-		results = append(results, result)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, err = w.Write(output)
+		if err != nil {
+			panic(err)
+		}
+
+		return
 	}
 
+	w.WriteHeader(http.StatusBadRequest)
 	search.tmpl.ExecuteWriter(pongo2.Context{
 		"query": query,
-
-		"page":     page,
-		"frompage": search.cfg.Frontend.cfg.PerPage * page,
-		"maxpages": resp.Hits.Total / search.cfg.Frontend.cfg.PerPage,
-		"prevpage": getPageLink(page-1, r.URL),
-		"nextpage": getPageLink(page+1, r.URL),
-
-		"elapsed":  time.Since(start) / time.Millisecond,
-		"response": resp,
-		"results":  results,
+		"error": parseErr.Error(),
 	}, w)
 }
 
@@ -124,9 +252,84 @@ func getPageLink(page int, inURL *url.URL) (outURL string) {
 
 	qry := inURL.Query()
 	qry.Set("p", strconv.Itoa(page))
-	inURL.RawQuery = qry.Encode()
 
-	outURL = inURL.String()
+	linkURL := *inURL
+	linkURL.RawQuery = qry.Encode()
+
+	outURL = linkURL.String()
+
+	return
+}
+
+// Remove all servers that do not match the server treats of a statement. As
+// Elasticsearch already matched the file, at least one server is kept.
+func filterServers(servers []Server, stmt Statement) (filtered []Server) {
+	var matchers []*regexp.Regexp
+	var operators []Operator
+	for _, treat := range stmt.Treats {
+		if treat.Key != keyServer || (treat.Operator != EQUALS && treat.Operator != NOT) {
+			continue
+		}
+
+		matchers = append(matchers, regexp.MustCompile("^(?:"+ServerRegex(treat.Value)+")$"))
+		operators = append(operators, treat.Operator)
+	}
+
+OUTER:
+	for _, server := range servers {
+		for i, matcher := range matchers {
+			if matcher.MatchString(server.Url) != (operators[i] == EQUALS) {
+				continue OUTER
+			}
+		}
+
+		filtered = append(filtered, server)
+	}
+
+	if len(filtered) == 0 {
+		filtered = servers
+	}
+
+	return
+}
+
+/* Attach highlighted paths to the servers. Elasticsearch returns the complete
+ * values of Servers.Path that matched, with the matches enclosed in the
+ * highlight tags. The path is HTML-escaped before adding <mark> tags, so it
+ * is safe to render it without escaping.
+ */
+func highlightServers(servers []Server, fragments []string) {
+	stripTags := strings.NewReplacer(highlightPreTag, "", highlightPostTag, "")
+	markTags := strings.NewReplacer(highlightPreTag, "<mark>", highlightPostTag, "</mark>")
+
+	for _, fragment := range fragments {
+		path := stripTags.Replace(fragment)
+
+		for i := range servers {
+			if servers[i].Path != path {
+				continue
+			}
+
+			servers[i].HighlightedPath = markTags.Replace(html.EscapeString(fragment))
+		}
+	}
+}
+
+// Get the names a file has on the servers besides its filename
+func otherNames(filename string, servers []Server) (names []string) {
+	seen := map[string]bool{}
+	for _, server := range servers {
+		name := path.Base(server.Path)
+		if server.ArchivePath != "" {
+			name = path.Base(server.ArchivePath)
+		}
+		if strings.EqualFold(name, filename) || seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		names = append(names, name)
+	}
 
 	return
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+/* Sort orders can be given using the sort GET parameter, e.g. sort=size or
+ * sort=name-desc, or using the sort treat, e.g. sort:size or sort<modified.
+ * Without a direction, every key has its own default direction.
+ */
+type SortOrder struct {
+	Key        string
+	Descending bool
+}
+
+type sortKey struct {
+	Field      string
+	Label      string
+	Descending bool
+}
+
+var sortKeys = map[string]sortKey{
+	"relevance": {Field: "_score", Label: "Relevance", Descending: true},
+	"size":      {Field: "Size", Label: "Size", Descending: true},
+	"modified":  {Field: "ModTime", Label: "Modified", Descending: true},
+	"seen":      {Field: "LastSeen", Label: "Last seen", Descending: true},
+	"name":      {Field: "Filename", Label: "Name", Descending: false},
+}
+
+// Order in which the sort links are shown
+var sortKeyOrder = []string{"relevance", "size", "modified", "seen", "name"}
+
+var DefaultSortOrder = SortOrder{Key: "relevance", Descending: true}
+
+// Parse the value of a sort treat. sort:key uses the default direction of
+// the key, sort<key sorts ascending and sort>key sorts descending.
+func ParseSortTreat(treat Treat) (order SortOrder, err error) {
+	key, ok := sortKeys[treat.Value]
+	if !ok {
+		err = fmt.Errorf("unknown sort order %s", treat.Value)
+		return
+	}
+
+	order = SortOrder{Key: treat.Value, Descending: key.Descending}
+	switch treat.Operator {
+	case LTE:
+		order.Descending = false
+	case GTE:
+		order.Descending = true
+	case EQUALS:
+	default:
+		err = fmt.Errorf("unsupported operator for %s", treat)
+	}
+
+	return
+}
+
+// Parse the sort GET parameter, e.g. size, size-asc or size-desc
+func ParseSortParam(value string) (order SortOrder, err error) {
+	treat := Treat{Key: keySort, Operator: EQUALS, Value: value}
+
+	switch {
+	case strings.HasSuffix(value, "-asc"):
+		treat.Operator = LTE
+		treat.Value = strings.TrimSuffix(value, "-asc")
+	case strings.HasSuffix(value, "-desc"):
+		treat.Operator = GTE
+		treat.Value = strings.TrimSuffix(value, "-desc")
+	}
+
+	return ParseSortTreat(treat)
+}
+
+/* Determine the sort order of a search. The GET parameter wins over the
+ * treat as it is used by the sort links of the results page. Invalid values
+ * are ignored, just like invalid treats.
+ */
+func GetSortOrder(param string, stmt Statement) (order SortOrder) {
+	order = DefaultSortOrder
+
+	for _, treat := range stmt.Treats {
+		if treat.Key != keySort {
+			continue
+		}
+
+		if treatOrder, err := ParseSortTreat(treat); err == nil {
+			order = treatOrder
+		}
+	}
+
+	if param != "" {
+		if paramOrder, err := ParseSortParam(param); err == nil {
+			order = paramOrder
+		}
+	}
+
+	return
+}
+
+// The GET parameter value of a sort order
+func (order SortOrder) Param() string {
+	if order.Descending {
+		return order.Key + "-desc"
+	}
+	return order.Key + "-asc"
+}
+
+// Create the Elasticsearch sort specification. Ties are broken by relevance.
+func (order SortOrder) Query() []hash {
+	direction := "asc"
+	if order.Descending {
+		direction = "desc"
+	}
+
+	field := sortKeys[order.Key].Field
+	if field == "_score" {
+		return []hash{{
+			"_score": hash{
+				"order": direction,
+			},
+		}}
+	}
+
+	return []hash{{
+		field: hash{
+			"order":   direction,
+			"missing": "_last",
+		},
+	}, {
+		"_score": hash{
+			"order": "desc",
+		},
+	}}
+}
+
+// view data structure
+type SortLink struct {
+	Label      string
+	Url        string
+	Active     bool
+	Descending bool
+}
+
+/* Create the sort links of the results page. Clicking the active sort order
+ * again reverses its direction. Sorting always starts on the first page.
+ */
+func getSortLinks(current SortOrder, inURL *url.URL) (links []SortLink) {
+	for _, name := range sortKeyOrder {
+		key := sortKeys[name]
+
+		order := SortOrder{Key: name, Descending: key.Descending}
+		if name == current.Key {
+			order.Descending = !current.Descending
+		}
+
+		qry := inURL.Query()
+		qry.Set("sort", order.Param())
+		qry.Del("p")
+
+		linkURL := *inURL
+		linkURL.RawQuery = qry.Encode()
+
+		links = append(links, SortLink{
+			Label:      key.Label,
+			Url:        linkURL.String(),
+			Active:     name == current.Key,
+			Descending: current.Descending,
+		})
+	}
+
+	return
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/barnslig/torture/lib/elastic"
+	"regexp"
+	"strings"
+)
+
+// Words as split by the filename tokenizer of the index, see CreateModel
+var filenameTokenRegex = regexp.MustCompile(`[\p{L}\d]+`)
+
+// JSON data structures
+type SpellingOption struct {
+	Text string `json:"text"`
+}
+
+type SpellingToken struct {
+	Text    string           `json:"text"`
+	Options []SpellingOption `json:"options"`
+}
+
+type SpellingSuggest struct {
+	DidYouMean []SpellingToken `json:"did_you_mean"`
+}
+
+/* Ask the term suggester of Elasticsearch for corrections of the words of a
+ * text. The suggestions are based on the filename tokens of Servers.Path, so
+ * only words that do not appear in any path are corrected. The returned map
+ * contains lower case words and their best correction.
+ */
+func (es *ElasticSearch) Corrections(text string) (corrections map[string]string, err error) {
+	data, err := elastic.Request("POST", elastic.URL(es.url, "/torture/file/_search"), hash{
+		"size": 0,
+		"suggest": hash{
+			"text": text,
+			"did_you_mean": hash{
+				"term": hash{
+					"field":        "Servers.Path",
+					"suggest_mode": "missing",
+					"sort":         "score",
+				},
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+
+	result, err := elastic.ParseResponse(data)
+	if err != nil || result.Suggest == nil {
+		return
+	}
+
+	suggest := SpellingSuggest{}
+	err = json.Unmarshal(*result.Suggest, &suggest)
+	if err != nil {
+		return
+	}
+
+	corrections = map[string]string{}
+	for _, token := range suggest.DidYouMean {
+		if len(token.Options) > 0 {
+			corrections[strings.ToLower(token.Text)] = token.Options[0].Text
+		}
+	}
+
+	return
+}
+
+// Find all phrases within an AST that are not negated
+func findPhrases(node Node) (phrases []string) {
+	switch n := node.(type) {
+	case Phrase:
+		phrases = append(phrases, n.Value)
+	case And:
+		for _, child := range n {
+			phrases = append(phrases, findPhrases(child)...)
+		}
+	case Or:
+		for _, child := range n {
+			phrases = append(phrases, findPhrases(child)...)
+		}
+	}
+	return
+}
+
+// Replace the words of all phrases within an AST by their corrections
+func correctPhrases(node Node, corrections map[string]string) Node {
+	switch n := node.(type) {
+	case Phrase:
+		n.Value = filenameTokenRegex.ReplaceAllStringFunc(n.Value, func(word string) string {
+			if correction, ok := corrections[strings.ToLower(word)]; ok {
+				return correction
+			}
+			return word
+		})
+		return n
+	case And:
+		corrected := And{}
+		for _, child := range n {
+			corrected = append(corrected, correctPhrases(child, corrections))
+		}
+		return corrected
+	case Or:
+		corrected := Or{}
+		for _, child := range n {
+			corrected = append(corrected, correctPhrases(child, corrections))
+		}
+		return corrected
+	}
+	return node
+}
+
+/* Suggest a corrected query for a statement. Returns an empty string if
+ * there is nothing to correct.
+ */
+func (es *ElasticSearch) DidYouMean(stmt Statement) (query string, err error) {
+	phrases := findPhrases(stmt.Root)
+	if len(phrases) == 0 {
+		return
+	}
+
+	corrections, err := es.Corrections(strings.Join(phrases, " "))
+	if err != nil || len(corrections) == 0 {
+		return
+	}
+
+	corrected := correctPhrases(stmt.Root, corrections).String()
+	if corrected != stmt.Root.String() {
+		query = corrected
+	}
+
+	return
+}
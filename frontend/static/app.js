@@ -1,3 +1,33 @@
 $(function () {
   $('[data-toggle="popover"]').popover();
+
+  // Search-as-you-type using /api/suggest
+  var $input = $('#form-search input[name="q"]');
+  var $suggestions = $('#search-suggestions');
+  var timeout = null;
+  var request = null;
+
+  $input.on('input', function () {
+    clearTimeout(timeout);
+    timeout = setTimeout(function () {
+      var query = $input.val();
+      if (request) {
+        request.abort();
+      }
+      if (!query) {
+        $suggestions.empty();
+        return;
+      }
+
+      request = $.getJSON('/api/suggest', { q: query }, function (data) {
+        $suggestions.empty();
+        $.each(data.suggestions, function (i, suggestion) {
+          $('<option>')
+            .attr('value', suggestion.query)
+            .text(suggestion.text)
+            .appendTo($suggestions);
+        });
+      });
+    }, 150);
+  });
 });
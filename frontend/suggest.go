@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Amount of filename suggestions
+const suggestSize = 8
+
+// Known values of treats, suggested after typing the key and operator
+var treatValues = map[Key][]string{
+	keyType: fileTypes,
+	keySort: sortKeyOrder,
+}
+
+// JSON data structures
+type Suggestion struct {
+	// What kind of suggestion this is: "treat" or "filename"
+	Kind string `json:"kind"`
+
+	// The suggested word, e.g. "type:" or a filename
+	Text string `json:"text"`
+
+	// The complete query after accepting the suggestion
+	Query string `json:"query"`
+}
+
+type SuggestResponse struct {
+	Query       string       `json:"query"`
+	Suggestions []Suggestion `json:"suggestions"`
+}
+
+// config and instance structures
+type SuggestConfig struct {
+	Frontend *Frontend
+}
+
+type Suggest struct {
+	cfg SuggestConfig
+}
+
+func CreateSuggest(cfg SuggestConfig) (suggest *Suggest, err error) {
+	suggest = &Suggest{cfg: cfg}
+	return
+}
+
+func (suggest *Suggest) Handler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	/* Parse GET parameters
+	 * q: The query typed so far
+	 */
+	query := r.FormValue("q")
+
+	out := SuggestResponse{
+		Query:       query,
+		Suggestions: suggestTreats(query),
+	}
+
+	// Suggest filenames matching the phrases typed so far. Treats are kept
+	// when a filename is accepted.
+	var phrases []string
+	var treats And
+	if stmt, err := TreatParser(strings.NewReader(query)); err == nil {
+		phrases = stmt.Phrases
+		for _, treat := range stmt.Treats {
+			treats = append(treats, treat)
+		}
+	} else {
+		phrases = strings.Fields(query)
+	}
+
+	if len(phrases) > 0 {
+		filenames, err := suggest.cfg.Frontend.elasticSearch.Suggest(strings.Join(phrases, " "), suggestSize)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, filename := range filenames {
+			out.Suggestions = append(out.Suggestions, Suggestion{
+				Kind:  "filename",
+				Text:  filename,
+				Query: append(treats, Phrase{Value: filename}).String(),
+			})
+		}
+	}
+
+	output, err := json.Marshal(out)
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(output)
+	if err != nil {
+		panic(err)
+	}
+}
+
+/* Suggest treats for the last, unfinished word of a query, e.g. "type:" for
+ * "ty" and "type:video" for "type:v".
+ */
+func suggestTreats(query string) (suggestions []Suggestion) {
+	suggestions = []Suggestion{}
+
+	// Only complete words that are still being typed
+	if query == "" || isWhitespace(rune(query[len(query)-1])) {
+		return
+	}
+
+	start := strings.LastIndexAny(query, " \t\n\r(-") + 1
+	prefix, word := query[:start], query[start:]
+
+	var texts []string
+	for name, key := range keys {
+		// Complete the key, e.g. "ty" --> "type:"
+		if strings.HasPrefix(name, word) && name != word {
+			texts = append(texts, name+":")
+			continue
+		}
+
+		// Complete the value, e.g. "type:v" --> "type:video"
+		for operatorName := range operators {
+			if !strings.HasPrefix(word, name+operatorName) {
+				continue
+			}
+
+			value := strings.TrimPrefix(word, name+operatorName)
+			for _, known := range treatValues[key] {
+				if strings.HasPrefix(known, value) && known != value {
+					texts = append(texts, name+operatorName+known)
+				}
+			}
+		}
+	}
+	sort.Strings(texts)
+
+	for _, text := range texts {
+		suggestions = append(suggestions, Suggestion{
+			Kind:  "treat",
+			Text:  text,
+			Query: prefix + text,
+		})
+	}
+
+	return
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
+	"strings"
 )
 
 type Treat struct {
@@ -12,8 +14,13 @@ type Treat struct {
 	Value    string
 }
 
+/* A parsed query. Root is the complete boolean expression. Phrases and Treats
+ * only contain the phrases and treats every result has to match, i.e. the
+ * ones that are neither negated nor part of an OR.
+ */
 type Statement struct {
 	Source  io.Reader
+	Root    Node
 	Phrases []string
 	Treats  []Treat
 }
@@ -29,14 +36,30 @@ const (
 	keySize
 	keyServer
 	keyType
+	keyModified
+	keySeen
+	keySort
 )
 
 var keys = map[string]Key{
 	"extension": keyExtension,
+	"modified":  keyModified,
+	"seen":      keySeen,
+	"server":    keyServer,
 	"size":      keySize,
+	"sort":      keySort,
 	"type":      keyType,
 }
 
+func (key Key) String() string {
+	for name, k := range keys {
+		if k == key {
+			return name
+		}
+	}
+	return ""
+}
+
 /* Operators specify how the treat should be applied. Only operators specified
  * within the operators map[string]Operator are identified as being part of
  * a treat! Multiple characters are possible, e.g. "=="
@@ -57,6 +80,92 @@ var operators = map[string]Operator{
 	">": GTE,
 }
 
+func (operator Operator) String() string {
+	for name, o := range operators {
+		if o == operator {
+			return name
+		}
+	}
+	return ""
+}
+
+func (treat Treat) String() string {
+	return treat.Key.String() + treat.Operator.String() + quote(treat.Value, false)
+}
+
+/* Put a value in double quotes if it would not survive the lexer otherwise,
+ * e.g. because it contains whitespaces. Quotes and backslashes are escaped
+ * using a backslash.
+ */
+func quote(value string, force bool) string {
+	if !force && value != "" && !strings.ContainsAny(value, " \t\n\r()") && !strings.HasPrefix(value, `"`) {
+		return value
+	}
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + escaper.Replace(value) + `"`
+}
+
+/* AST
+ * The parser turns a query into a tree of nodes. Treats are nodes, too.
+ * Calling String() on a node gives back an equivalent query string.
+ */
+type Node interface {
+	String() string
+}
+
+// A search term, matched against the file path
+type Phrase struct {
+	Value string
+
+	// Quoted phrases have to match exactly and in this order
+	Exact bool
+}
+
+// All nodes have to match
+type And []Node
+
+// At least one of the nodes has to match
+type Or []Node
+
+// The node must not match
+type Not struct {
+	Node Node
+}
+
+func (phrase Phrase) String() string {
+	return quote(phrase.Value, phrase.Exact)
+}
+
+func (and And) String() string {
+	parts := make([]string, len(and))
+	for i, node := range and {
+		parts[i] = node.String()
+
+		// OR binds weaker than AND
+		if _, isOr := node.(Or); isOr {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (or Or) String() string {
+	parts := make([]string, len(or))
+	for i, node := range or {
+		parts[i] = node.String()
+	}
+	return strings.Join(parts, " OR ")
+}
+
+func (not Not) String() string {
+	switch not.Node.(type) {
+	case And, Or:
+		return "-(" + not.Node.String() + ")"
+	}
+	return "-" + not.Node.String()
+}
+
 /* LEXER
  * Tokenizes the input for further processing. Usually you just skip this and
  * take a look at the parser.
@@ -68,12 +177,34 @@ const (
 	KEY
 	OPERATOR
 	STRING
+	LPAREN
+	RPAREN
+	MINUS
+	OR
+	AND
+	QUOTED
+	ILLEGAL
 )
 
 const EOF = rune(0)
 
+// What the lexer expects next. Operators only follow keys and values only
+// follow operators, so e.g. "OR" is a value in "server:OR" and not a keyword.
+type lexerState int
+
+const (
+	lexDefault lexerState = iota
+	lexAfterKey
+	lexAfterOperator
+)
+
 type TreatLexer struct {
-	r *bufio.Reader
+	r     *bufio.Reader
+	pos   int
+	state lexerState
+
+	// Position of the last token within the input, counted in runes
+	Pos int
 }
 
 func CreateTreatLexer(src io.Reader) (tl TreatLexer) {
@@ -83,6 +214,43 @@ func CreateTreatLexer(src io.Reader) (tl TreatLexer) {
 	return
 }
 
+func (tl *TreatLexer) read() rune {
+	ch, _, err := tl.r.ReadRune()
+	if err != nil {
+		return EOF
+	}
+	tl.pos++
+	return ch
+}
+
+func (tl *TreatLexer) unread(ch rune) {
+	if ch == EOF {
+		return
+	}
+	tl.r.UnreadRune()
+	tl.pos--
+}
+
+func (tl *TreatLexer) peek() rune {
+	ch := tl.read()
+	tl.unread(ch)
+	return ch
+}
+
+func isWhitespace(ch rune) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'
+}
+
+// Whether an operator starts with the given rune
+func isOperatorStart(ch rune) bool {
+	for operator := range operators {
+		if strings.HasPrefix(operator, string(ch)) {
+			return true
+		}
+	}
+	return false
+}
+
 /* Get the next token from a query string and the corresponding value. Parsing
  * has to be done elsewhere - this is just the lexer.
  */
@@ -90,17 +258,20 @@ func (tl *TreatLexer) Next() (token Token, value string) {
 	token = NIL
 	var current bytes.Buffer
 
+	state := tl.state
+	tl.state = lexDefault
+
 Loop:
 	for {
-		ch, _, err := tl.r.ReadRune()
+		ch := tl.read()
 
 		// No character or EOF
-		if err != nil || ch == EOF {
+		if ch == EOF {
 			break Loop
 		}
 
 		// Whitespaces separate our tokens
-		if ch == ' ' || ch == '\t' || ch == '\n' {
+		if isWhitespace(ch) {
 			// If we found nothing by now, better continue until we have something
 			if token == NIL {
 				continue
@@ -110,101 +281,392 @@ Loop:
 			break Loop
 		}
 
-		current.WriteRune(ch)
-		_, isKey := keys[current.String()]
-		_, isOperator := operators[current.String()]
+		// Parentheses are tokens on their own and end the current token
+		if ch == '(' || ch == ')' {
+			if token != NIL {
+				tl.unread(ch)
+				break Loop
+			}
 
-		switch {
-		// Find keys
-		case isKey:
-			token = KEY
-			break Loop
-		/* Find operators. Operators always follow a Key as otherwise the token
-		 * is not splitted.
-		 */
-		case isOperator:
-			token = OPERATOR
+			tl.Pos = tl.pos - 1
+			current.WriteRune(ch)
+			token = LPAREN
+			if ch == ')' {
+				token = RPAREN
+			}
 			break Loop
-		// Fuck it, it's an arbitary string
-		default:
-			token = STRING
 		}
+
+		if token == NIL {
+			tl.Pos = tl.pos - 1
+
+			// Double quotes enclose a single token, e.g. "the matrix"
+			if ch == '"' {
+				var terminated bool
+				value, terminated = tl.readQuoted()
+				token = QUOTED
+				if !terminated {
+					token = ILLEGAL
+				}
+				return
+			}
+
+			// A minus directly in front of a term negates it
+			if ch == '-' && state == lexDefault {
+				next := tl.peek()
+				if next != EOF && !isWhitespace(next) && next != ')' {
+					current.WriteRune(ch)
+					token = MINUS
+					break Loop
+				}
+			}
+		}
+
+		current.WriteRune(ch)
+
+		switch state {
+		// Find operators. Operators always follow a Key as otherwise the token
+		// is not splitted.
+		case lexAfterKey:
+			if _, isOperator := operators[current.String()]; isOperator {
+				token = OPERATOR
+				tl.state = lexAfterOperator
+				break Loop
+			}
+
+		// Find keys. Keys are only keys if an operator follows, so e.g.
+		// "typewriter" is not splitted into "type" and "writer"
+		case lexDefault:
+			if _, isKey := keys[current.String()]; isKey && isOperatorStart(tl.peek()) {
+				token = KEY
+				tl.state = lexAfterKey
+				break Loop
+			}
+		}
+
+		// Fuck it, it's an arbitary string
+		token = STRING
 	}
 
 	value = current.String()
+
+	// Upper case OR and AND are boolean operators, but not within treats
+	if token == STRING && state == lexDefault {
+		switch value {
+		case "OR":
+			token = OR
+		case "AND":
+			token = AND
+		}
+	}
+
 	return
 }
 
+/* Read a quoted string up to the closing double quote. A backslash escapes
+ * the next character, so \" and \\ stand for a double quote and a backslash.
+ */
+func (tl *TreatLexer) readQuoted() (value string, terminated bool) {
+	var current bytes.Buffer
+
+	for {
+		ch := tl.read()
+
+		switch ch {
+		case EOF:
+			value = current.String()
+			return
+		case '"':
+			value = current.String()
+			terminated = true
+			return
+		case '\\':
+			ch = tl.read()
+			if ch == EOF {
+				value = current.String()
+				return
+			}
+		}
+
+		current.WriteRune(ch)
+	}
+}
+
 /* PARSER
- * Tries to recognize patterns within the already tokenized input via a state
- * machine so we get out a Statement consisting of Phrases and Treats.
+ * A recursive descent parser building an AST from the tokenized input:
+ *
+ *   query   := orExpr EOF
+ *   orExpr  := andExpr { "OR" andExpr }
+ *   andExpr := unary { [ "AND" ] unary }
+ *   unary   := "-" unary | primary
+ *   primary := "(" orExpr ")" | KEY OPERATOR value | value
+ *   value   := STRING | QUOTED
  */
-type ParserState int
+type ParseError struct {
+	Pos int
+	Msg string
+}
 
-const (
-	PKEY ParserState = iota
-	POPERATOR
-	PSTRING
-)
+func (err *ParseError) Error() string {
+	if err.Pos < 0 {
+		return fmt.Sprintf("Invalid query: %s", err.Msg)
+	}
+	return fmt.Sprintf("Invalid query at position %d: %s", err.Pos+1, err.Msg)
+}
+
+type treatParser struct {
+	lexer TreatLexer
+	token Token
+	value string
+	pos   int
+
+	// Amount of currently open parentheses
+	depth int
+}
+
+func (p *treatParser) next() {
+	p.token, p.value = p.lexer.Next()
+	p.pos = p.lexer.Pos
+	if p.token == NIL {
+		p.pos = p.lexer.pos
+	}
+}
+
+func (p *treatParser) fail(format string, args ...interface{}) error {
+	return &ParseError{Pos: p.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *treatParser) unopened() error {
+	if p.depth > 0 {
+		return p.fail("empty parentheses")
+	}
+	return p.fail("closing parenthesis without an opening one")
+}
+
+func (p *treatParser) orExpr() (node Node, err error) {
+	var or Or
+	for {
+		node, err = p.andExpr()
+		if err != nil {
+			return
+		}
+		or = append(or, node)
+
+		if p.token != OR {
+			break
+		}
+		p.next()
+	}
+
+	if len(or) > 1 {
+		node = or
+	}
+	return
+}
+
+func (p *treatParser) andExpr() (node Node, err error) {
+	var and And
+	for {
+		if p.token == AND {
+			if len(and) == 0 {
+				err = p.fail("AND needs a term on its left side")
+				return
+			}
+			p.next()
+		}
+
+		if p.token == NIL || p.token == RPAREN || p.token == OR {
+			break
+		}
+
+		node, err = p.unary()
+		if err != nil {
+			return
+		}
+		and = append(and, node)
+	}
+
+	switch len(and) {
+	case 0:
+		switch p.token {
+		case OR:
+			err = p.fail("OR needs a term on both sides")
+		case RPAREN:
+			err = p.unopened()
+		default:
+			err = p.fail("missing term")
+		}
+	case 1:
+		node = and[0]
+	default:
+		node = and
+	}
+	return
+}
+
+func (p *treatParser) unary() (node Node, err error) {
+	if p.token == MINUS {
+		p.next()
+		node, err = p.unary()
+		if err != nil {
+			return
+		}
+
+		// Double negation cancels out
+		if not, isNot := node.(Not); isNot {
+			node = not.Node
+			return
+		}
+
+		node = Not{Node: node}
+		return
+	}
+
+	return p.primary()
+}
+
+func (p *treatParser) primary() (node Node, err error) {
+	switch p.token {
+	case LPAREN:
+		p.depth++
+		p.next()
+		node, err = p.orExpr()
+		if err != nil {
+			return
+		}
+
+		if p.token != RPAREN {
+			err = p.fail("missing closing parenthesis")
+			return
+		}
+		p.depth--
+		p.next()
+
+	case KEY:
+		treat := Treat{Key: keys[p.value]}
+		treatPos := p.pos
+
+		// The lexer only emits keys that are followed by an operator
+		p.next()
+		treat.Operator = operators[p.value]
+
+		p.next()
+		if p.token == ILLEGAL {
+			err = p.fail("missing closing quote")
+			return
+		}
+		if p.token != STRING && p.token != QUOTED {
+			err = p.fail("missing value for %s%s", treat.Key, treat.Operator)
+			return
+		}
+		treat.Value = p.value
+
+		// Reject treats that can not be searched for, e.g. type:vidoe.
+		// Sorting is not a filter, see SortOrder
+		if treat.Key != keySort {
+			if _, tErr := TreatQuery(treat); tErr != nil {
+				err = &ParseError{Pos: treatPos, Msg: tErr.Error()}
+				return
+			}
+		}
+
+		node = treat
+		p.next()
+
+	case STRING, QUOTED:
+		node = Phrase{Value: p.value, Exact: p.token == QUOTED}
+		p.next()
+
+	case ILLEGAL:
+		err = p.fail("missing closing quote")
+
+	default:
+		err = p.fail("unexpected %q", p.value)
+	}
+
+	return
+}
 
 /* Parses a query string which might contain treat directives into a Statement
  * struct. Treats consist of [key][operator][value], e.g. size>20mb.
  * Everything not being a treat consisting of the pre-specified keys and
  * operators is interpreted as part of the actual search query.
  *
+ * Terms are combined using AND by default. OR, parentheses and negation using
+ * a leading minus are supported, too. Malformed queries result in a
+ * *ParseError.
+ *
  * Example:
- *   fp := TreatParser("filetype:pdf size>20mb size<50mb server!ftp.gnu.org scientific paper writing")
+ *   stmt, err := TreatParser(`extension:pdf size>20mb -draft (server:ftp.gnu.org OR server:"ftp://my host") "scientific paper" writing`)
  */
-func TreatParser(src io.Reader) (stmt Statement) {
-	stmt = Statement{Source: src}
+func TreatParser(src io.Reader) (stmt Statement, err error) {
+	stmt = Statement{Source: src, Root: And{}}
 
-	state := PSTRING
-	var previousValue string
-	var currentTreat Treat
+	p := &treatParser{lexer: CreateTreatLexer(src)}
+	p.next()
 
-	lexer := CreateTreatLexer(src)
-	for {
-		token, value := lexer.Next()
+	// An empty query matches everything
+	if p.token == NIL {
+		return
+	}
 
-		switch token {
-		case KEY:
-			currentTreat = Treat{
-				Key: keys[value],
-			}
-			state = PKEY
-			break
-		case OPERATOR:
-			state = POPERATOR
-			currentTreat.Operator = operators[value]
-			break
-		case STRING:
-			// Possible states at this point: PKEY, POPERATOR, PSTRING
-
-			// We already have key+operator, add the value
-			if state == POPERATOR {
-				currentTreat.Value = value
-				stmt.Treats = append(stmt.Treats, currentTreat)
-				state = PSTRING
-				break
-			}
+	stmt.Root, err = p.orExpr()
+	if err != nil {
+		return
+	}
 
-			// Whoops a key without a following operator. Think of both as phrases!
-			if state == PKEY {
-				stmt.Phrases = append(stmt.Phrases, previousValue)
-			}
+	if p.token == RPAREN {
+		err = p.unopened()
+		return
+	}
 
-			// Otherwise: This is a usual string, just add it to the phrases …
-			stmt.Phrases = append(stmt.Phrases, value)
-			state = PSTRING
-			break
-		}
+	// Collect the phrases and treats every result has to match
+	required := []Node{stmt.Root}
+	if and, isAnd := stmt.Root.(And); isAnd {
+		required = and
+	}
 
-		previousValue = value
+	for _, node := range required {
+		switch n := node.(type) {
+		case Phrase:
+			stmt.Phrases = append(stmt.Phrases, n.Value)
+		case Treat:
+			stmt.Treats = append(stmt.Treats, n)
+		}
+	}
 
-		if token == NIL {
-			break
+	// Sorting applies to the whole result list
+	sortTreats := 0
+	for _, treat := range stmt.Treats {
+		if treat.Key == keySort {
+			sortTreats++
 		}
 	}
+	if len(findTreats(stmt.Root, keySort)) != sortTreats {
+		err = &ParseError{Pos: -1, Msg: "sort can not be negated, grouped or combined using OR"}
+		return
+	}
 
 	return
 }
+
+// Find all treats with the given key within an AST
+func findTreats(node Node, key Key) (treats []Treat) {
+	switch n := node.(type) {
+	case Treat:
+		if n.Key == key {
+			treats = append(treats, n)
+		}
+	case Not:
+		treats = findTreats(n.Node, key)
+	case And:
+		for _, child := range n {
+			treats = append(treats, findTreats(child, key)...)
+		}
+	case Or:
+		for _, child := range n {
+			treats = append(treats, findTreats(child, key)...)
+		}
+	}
+	return
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func parse(t *testing.T, query string) Statement {
+	stmt, err := TreatParser(strings.NewReader(query))
+	if err != nil {
+		t.Fatalf("%q: unexpected error: %s", query, err)
+	}
+	return stmt
+}
+
+func TestTreatParserAST(t *testing.T) {
+	tests := []struct {
+		query string
+		root  Node
+	}{
+		// Precedence: AND binds stronger than OR
+		{"a b OR c", Or{And{Phrase{Value: "a"}, Phrase{Value: "b"}}, Phrase{Value: "c"}}},
+		{"a OR b c", Or{Phrase{Value: "a"}, And{Phrase{Value: "b"}, Phrase{Value: "c"}}}},
+		{"a AND b", And{Phrase{Value: "a"}, Phrase{Value: "b"}}},
+
+		// Grouping
+		{"a (b OR c)", And{Phrase{Value: "a"}, Or{Phrase{Value: "b"}, Phrase{Value: "c"}}}},
+		{"((a))", Phrase{Value: "a"}},
+
+		// Negation
+		{"-a", Not{Node: Phrase{Value: "a"}}},
+		{"--a", Phrase{Value: "a"}},
+		{"-(a b)", Not{Node: And{Phrase{Value: "a"}, Phrase{Value: "b"}}}},
+		{"a-b", Phrase{Value: "a-b"}},
+
+		// Quoting and escapes
+		{`"the matrix"`, Phrase{Value: "the matrix", Exact: true}},
+		{`"a \"b\" \\ c"`, Phrase{Value: `a "b" \ c`, Exact: true}},
+		{`"OR"`, Phrase{Value: "OR", Exact: true}},
+		{`server:"ftp://my host"`, Treat{Key: keyServer, Operator: EQUALS, Value: "ftp://my host"}},
+
+		// Treats
+		{"size>20mb", Treat{Key: keySize, Operator: GTE, Value: "20mb"}},
+		{"server!10.0.*", Treat{Key: keyServer, Operator: NOT, Value: "10.0.*"}},
+		{"server:OR", Treat{Key: keyServer, Operator: EQUALS, Value: "OR"}},
+		{"-extension:pdf", Not{Node: Treat{Key: keyExtension, Operator: EQUALS, Value: "pdf"}}},
+
+		// Only known keys followed by an operator are treats
+		{"typewriter", Phrase{Value: "typewriter"}},
+		{"csi:miami", Phrase{Value: "csi:miami"}},
+	}
+
+	for _, test := range tests {
+		stmt := parse(t, test.query)
+		if !reflect.DeepEqual(stmt.Root, test.root) {
+			t.Errorf("%q: got %#v, want %#v", test.query, stmt.Root, test.root)
+		}
+
+		// String gives back an equivalent query
+		again := parse(t, stmt.Root.String())
+		if !reflect.DeepEqual(again.Root, stmt.Root) {
+			t.Errorf("%q: %q parses to %#v", test.query, stmt.Root.String(), again.Root)
+		}
+	}
+}
+
+func TestTreatParserRequired(t *testing.T) {
+	stmt := parse(t, `extension:pdf -draft "scientific paper" (a OR b) writing`)
+
+	phrases := []string{"scientific paper", "writing"}
+	if !reflect.DeepEqual(stmt.Phrases, phrases) {
+		t.Errorf("got phrases %q, want %q", stmt.Phrases, phrases)
+	}
+
+	treats := []Treat{{Key: keyExtension, Operator: EQUALS, Value: "pdf"}}
+	if !reflect.DeepEqual(stmt.Treats, treats) {
+		t.Errorf("got treats %v, want %v", stmt.Treats, treats)
+	}
+
+	// Nothing is required by every result of an OR
+	stmt = parse(t, "a OR extension:pdf")
+	if len(stmt.Phrases) != 0 || len(stmt.Treats) != 0 {
+		t.Errorf("got phrases %q and treats %v, want none", stmt.Phrases, stmt.Treats)
+	}
+}
+
+func TestTreatParserSort(t *testing.T) {
+	stmt := parse(t, "a sort:size-desc")
+	treats := []Treat{{Key: keySort, Operator: EQUALS, Value: "size-desc"}}
+	if !reflect.DeepEqual(stmt.Treats, treats) {
+		t.Errorf("got treats %v, want %v", stmt.Treats, treats)
+	}
+
+	for _, query := range []string{
+		"-sort:size",
+		"a OR sort:size",
+		"a (b sort:size)",
+	} {
+		_, err := TreatParser(strings.NewReader(query))
+		if _, ok := err.(*ParseError); !ok {
+			t.Errorf("%q: got %v, want a *ParseError", query, err)
+		}
+	}
+}
+
+func TestTreatParserErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+	}{
+		{"a OR", 4},
+		{"OR a", 0},
+		{"AND a", 0},
+		{"a OR OR b", 5},
+		{"(a", 2},
+		{"a)", 1},
+		{"()", 1},
+		{`"abc`, 0},
+		{`server:"abc`, 7},
+		{"size>", 5},
+
+		// Treats that can not be searched for are reported at their key
+		{"type:vidoe", 0},
+		{"a size>abc", 2},
+		{"modified>2023-13-45", 0},
+		{"a OR modified:3d", 5},
+		{"(a OR extension>pdf)", 6},
+		{"-seen:yesterday", 1},
+	}
+
+	for _, test := range tests {
+		_, err := TreatParser(strings.NewReader(test.query))
+		parseErr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%q: got %v, want a *ParseError", test.query, err)
+			continue
+		}
+		if parseErr.Pos != test.pos {
+			t.Errorf("%q: got error %q at %d, want it at %d", test.query, parseErr.Msg, parseErr.Pos, test.pos)
+		}
+	}
+}
+
+func TestTreatParserEmpty(t *testing.T) {
+	for _, query := range []string{"", "   "} {
+		stmt := parse(t, query)
+		if !reflect.DeepEqual(stmt.Root, And{}) {
+			t.Errorf("%q: got %#v, want an empty And", query, stmt.Root)
+		}
+	}
+}
+
+func TestCompileQueryInvalidTreat(t *testing.T) {
+	// A rejected operand must not turn the OR into a match-all query
+	root := Or{Phrase{Value: "a"}, Treat{Key: keyType, Operator: EQUALS, Value: "vidoe"}}
+
+	query, err := CompileQuery(root)
+	if err == nil {
+		t.Errorf("got query %v, want an error", query)
+	}
+
+	// Sort treats do not restrict the results
+	query, err = CompileQuery(And{Treat{Key: keySort, Operator: EQUALS, Value: "size"}})
+	if query != nil || err != nil {
+		t.Errorf("got query %v and error %v, want neither", query, err)
+	}
+}
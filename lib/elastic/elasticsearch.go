@@ -11,9 +11,10 @@ import (
 )
 
 type Hit struct {
-	Id     string           `json:"_id"`
-	Score  float32          `json:"_score"`
-	Source *json.RawMessage `json:"_source"`
+	Id        string              `json:"_id"`
+	Score     float32             `json:"_score"`
+	Source    *json.RawMessage    `json:"_source"`
+	Highlight map[string][]string `json:"highlight,omitempty"`
 }
 
 type Hits struct {
@@ -22,12 +23,27 @@ type Hits struct {
 }
 
 type Result struct {
+	ScrollId     string           `json:"_scroll_id,omitempty"`
 	Hits         Hits             `json:"hits"`
 	Aggregations *json.RawMessage `json:"aggregations"`
+	Suggest      *json.RawMessage `json:"suggest"`
 }
 
 type Error struct {
-	Type string `json:"type"`
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// The outcome of a single action of a bulk request
+type BulkItem struct {
+	Id     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *Error `json:"error,omitempty"`
+}
+
+type BulkResult struct {
+	Errors bool                  `json:"errors"`
+	Items  []map[string]BulkItem `json:"items"`
 }
 
 // Add a path to a given host
@@ -63,6 +79,38 @@ func Request(method string, url string, payload interface{}) (data []byte, err e
 
 	req.Header.Add("Content-Type", "application/json")
 
+	return do(req)
+}
+
+// Send multiple actions at once using the _bulk API. Every line is encoded as
+// a single line of JSON, so actions and their sources alternate
+func Bulk(url string, lines []interface{}) (result BulkResult, err error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, line := range lines {
+		err = enc.Encode(line)
+		if err != nil {
+			return
+		}
+	}
+
+	req, err := http.NewRequest("POST", url, &body)
+	if err != nil {
+		return
+	}
+
+	req.Header.Add("Content-Type", "application/x-ndjson")
+
+	data, err := do(req)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &result)
+	return
+}
+
+func do(req *http.Request) (data []byte, err error) {
 	// Do the HTTP request
 	client := &http.Client{}
 	resp, err := client.Do(req)